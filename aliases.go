@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+// ================= USER ALIASES =================
+
+// loadUserAliases reads USER_ALIAS_FILE, either a JSON object or KEY=VALUE
+// lines with # comments, mapping Xray user names to the names exported in
+// the name label. Two users may not share an alias since their series would
+// collide.
+func loadUserAliases(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("USER_ALIAS_FILE: %w", err)
+	}
+
+	aliases := make(map[string]string)
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		if err := json.Unmarshal(data, &aliases); err != nil {
+			return nil, fmt.Errorf("USER_ALIAS_FILE %s: %w", path, err)
+		}
+	} else {
+		for n, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, alias, ok := strings.Cut(line, "=")
+			user, alias = strings.TrimSpace(user), strings.TrimSpace(alias)
+			if !ok || user == "" || alias == "" {
+				return nil, fmt.Errorf("USER_ALIAS_FILE %s:%d: expected user=alias", path, n+1)
+			}
+			aliases[user] = alias
+		}
+	}
+
+	owners := make(map[string]string, len(aliases))
+	for user, alias := range aliases {
+		if other, taken := owners[alias]; taken {
+			return nil, fmt.Errorf("USER_ALIAS_FILE %s: users %q and %q share the alias %q", path, other, user, alias)
+		}
+		owners[alias] = user
+	}
+	return aliases, nil
+}
+
+// UserAlias returns the name exported for user, the user itself when it has
+// no alias. The aliases are loaded by Validate.
+func (c *Config) UserAlias(user string) string {
+	if alias, ok := c.userAliases[user]; ok {
+		return alias
+	}
+	return user
+}
+
+// warnedAliasCollisions remembers the aliases aliasTaken warned about, so a
+// collision is logged once instead of on every scrape.
+var warnedAliasCollisions sync.Map
+
+// statUsers returns the users in stats for aliasTaken, nil when there are no
+// aliases to collide.
+func statUsers(stats []*statsService.Stat) map[string]struct{} {
+	if len(AppConfig().userAliases) == 0 {
+		return nil
+	}
+	users := make(map[string]struct{})
+	for _, stat := range stats {
+		if !strings.HasPrefix(stat.Name, "user>>>") {
+			continue
+		}
+		if user, ok := parseUser(stat.Name); ok {
+			users[user] = struct{}{}
+		}
+	}
+	return users
+}
+
+// aliasTaken reports whether the alias of user is the name of another user
+// in users, the series of both would collide. Callers skip the aliased user.
+func aliasTaken(users map[string]struct{}, user string) bool {
+	alias := AppConfig().UserAlias(user)
+	if _, taken := users[alias]; !taken || alias == user {
+		return false
+	}
+	if _, warned := warnedAliasCollisions.LoadOrStore(alias, struct{}{}); !warned {
+		slog.Warn("USER_ALIAS_FILE alias is the name of another user, skipping the aliased user", "user", user, "alias", alias)
+	}
+	return true
+}
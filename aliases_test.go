@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+func writeAliasFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadUserAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"lines", "# comment\nalice@x = alice\n\nbob@x=bob\n", map[string]string{"alice@x": "alice", "bob@x": "bob"}, false},
+		{"json", `{"alice@x": "alice"}`, map[string]string{"alice@x": "alice"}, false},
+		{"missing alias", "alice@x=\n", nil, true},
+		{"shared alias", "alice@x=a\nbob@x=a\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadUserAliases(writeAliasFile(t, tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Errorf("aliases = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAliasCollidingWithUser(t *testing.T) {
+	setTestConfig(t, map[string]string{"USER_ALIAS_FILE": writeAliasFile(t, "alice@x=bob\ncarol@x=carol\n")})
+	stats := &fakeStats{stats: []*statsService.Stat{
+		stat("user>>>alice@x>>>traffic>>>uplink", 10),
+		stat("user>>>bob>>>traffic>>>uplink", 20),
+		stat("user>>>carol@x>>>traffic>>>uplink", 30),
+	}}
+	c := NewXrayTrafficCollector(context.Background(), newStatsCache(stats, 0, false), &trafficTotals{})
+
+	// Gathering fails on duplicate series, alice@x must be skipped instead
+	expected := `
+# HELP xray_traffic_bytes_total Xray traffic statistics
+# TYPE xray_traffic_bytes_total counter
+xray_traffic_bytes_total{direction="uplink",name="bob",type="user"} 20
+xray_traffic_bytes_total{direction="uplink",name="carol",type="user"} 30
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "xray_traffic_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAliasCollidingWithOnlineUser(t *testing.T) {
+	setTestConfig(t, map[string]string{"USER_ALIAS_FILE": writeAliasFile(t, "alice@x=bob\n")})
+	stats := &fakeStats{
+		stats: []*statsService.Stat{
+			stat("user>>>alice@x>>>traffic>>>uplink", 10),
+			stat("user>>>bob>>>traffic>>>uplink", 20),
+		},
+		online: map[string]map[string]int64{
+			"alice@x": {"203.0.113.1": 1, "203.0.113.2": 1},
+			"bob":     {"203.0.113.3": 1},
+		},
+	}
+	inst := newTestInstance(t, "test-alias", stats)
+
+	if _, err := scrapeOnlineUsersAndHealth(context.Background(), inst); err != nil {
+		t.Fatalf("scrapeOnlineUsersAndHealth: %v", err)
+	}
+	// Only bob's own IPs, alice@x is left out instead of merged in
+	expected := `
+# HELP xray_user_ip_online User online status per IP (1=online)
+# TYPE xray_user_ip_online gauge
+xray_user_ip_online{instance="test-alias",ip="203.0.113.3",name="bob"} 1
+`
+	if err := testutil.CollectAndCompare(xrayUserIPOnline, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(xrayUserOnlineIPCount.WithLabelValues("test-alias", "bob")); got != 1 {
+		t.Errorf("xray_user_online_ip_count{name=bob} = %v, want 1", got)
+	}
+}
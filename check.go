@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ================= HEALTH CHECK =================
+
+// runHealthCheck requests /healthz from the exporter listening on cfg and
+// returns the process exit code, so containers can use the binary itself
+// as HEALTHCHECK without shipping curl.
+func runHealthCheck(cfg *Config) int {
+	host := cfg.BindAddress
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	scheme := "http"
+	if cfg.TLSCertFile != "" {
+		scheme = "https"
+	}
+	url := scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(cfg.Port))) + "/healthz"
+
+	client := &http.Client{
+		Timeout: 3 * time.Second,
+		// The serving certificate is usually not issued for localhost
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "health check failed:", err)
+		return 1
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "health check failed:", resp.Status)
+		return 1
+	}
+	return 0
+}
@@ -1,28 +1,785 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"google.golang.org/grpc/encoding/gzip"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	XrayApi string
-	Port    uint16
+	XrayApis            []string
+	XrayApiTLS          bool
+	XrayApiCAFile       string
+	XrayApiClientCert   string
+	XrayApiClientKey    string
+	XrayApiServerName   string
+	XrayApiSkipVerify   bool
+	XrayApiProxy        string
+	KeepaliveTime       time.Duration
+	KeepaliveTimeout    time.Duration
+	KeepaliveNoStream   bool
+	GRPCCompression     string
+	DialTimeout         time.Duration
+	WaitForReady        bool
+	Port                uint16
+	AdminPort           uint16
+	ScrapeInterval      time.Duration
+	FailInterval        time.Duration
+	FailThreshold       int
+	FailBackoffMax      time.Duration
+	StartupDelay        time.Duration
+	RPCRetries          int
+	RPCTimeout          time.Duration
+	RuntimeMetrics      bool
+	OnlineIPConcurrency int
+	OnlineIPSpread      int
+	StatsCacheTTL       time.Duration
+	StatsSoftLimit      int
+	ShutdownTimeout     time.Duration
+	HTTPReadTimeout     time.Duration
+	HTTPWriteTimeout    time.Duration
+	HTTPIdleTimeout     time.Duration
+	TLSCertFile         string
+	TLSKeyFile          string
+	MetricsUsername     string
+	MetricsPassword     string
+	MetricsPath         string
+	MetricsAllowCIDRs   []string
+	TrustProxy          bool
+	BindAddress         string
+	LogLevel            string
+	LogFormat           string
+	LogHTTPRequests     bool
+	ResetTraffic        bool
+	ResetSchedule       string
+	MaxIPsPerUser       int
+	GeoIPDB             string
+	ReverseDNS          bool
+	ReverseDNSTTL       time.Duration
+	IPMask              []string
+	UserIncludeRegex    string
+	UserExcludeRegex    string
+	UserAliasFile       string
+	XrayConfigFile      string
+	TrafficEnabled      bool
+	TrafficTypeDeny     []string
+	IncludeZeroTraffic  bool
+	DirectionMapping    []string
+	OnlineUsersEnabled  bool
+	UpFromConnection    bool
+	RateMetrics         bool
+	UserTotals          bool
+	SplitTraffic        bool
+	TrafficTotals       bool
+	Exemplars           bool
+	ConfigEndpoint      bool
+	JSONEndpoint        bool
+	ManualScrape        bool
+	DebugScrapes        bool
+	Pprof               bool
+	PushgatewayURL      string
+	PushgatewayJob      string
+	PushgatewayGrouping []string
+	OTLPEndpoint        string
+	OTLPInsecure        bool
+	MetricsEndpoint     bool
+	MetricNamespace     string
+	InstanceLabel       string
+
+	userInclude *regexp.Regexp
+	userExclude *regexp.Regexp
+	userAliases map[string]string
+	tagNames    map[string]map[string]string
+	// resetSchedule is RESET_SCHEDULE parsed, nil without one
+	resetSchedule cron.Schedule
+	directions    map[string]string
+	allowedNets   []netip.Prefix
+	// ipMaskBits are the IP_MASK prefix lengths for IPv4 and IPv6, 0 when
+	// not masked
+	ipMaskBits [2]int
+	// loadErr is reported by Validate so a bad ENV_FILE fails like any
+	// other invalid setting
+	loadErr error
+}
+
+// appConfig holds the active configuration, loadConfig is re-run and the
+// result swapped in on SIGHUP.
+var appConfig = newConfigHolder(loadConfig())
+
+func newConfigHolder(cfg *Config) *atomic.Pointer[Config] {
+	holder := new(atomic.Pointer[Config])
+	holder.Store(cfg)
+	return holder
+}
+
+// AppConfig returns the active configuration. Callers that need several
+// consistent values should take it once instead of calling it repeatedly.
+func AppConfig() *Config {
+	return appConfig.Load()
 }
 
-var AppConfig = &Config{
-	XrayApi: func() string {
-		if v := os.Getenv("XRAY_API"); v != "" {
-			return v
+// loadConfig reads the configuration from the environment, after applying
+// ENV_FILE when one is set, falling back to CONFIG_FILE for unset variables.
+func loadConfig() *Config {
+	loadErr := errors.Join(
+		applyEnvFile(os.Getenv("ENV_FILE")),
+		loadConfigFile(os.Getenv("CONFIG_FILE")),
+	)
+	cfg := &Config{
+		XrayApis:            envList("XRAY_APIS", envList("XRAY_API", []string{"127.0.0.1:8080"})),
+		XrayApiTLS:          envBool("XRAY_API_TLS", false),
+		XrayApiCAFile:       envString("XRAY_API_CA_FILE", ""),
+		XrayApiClientCert:   envString("XRAY_API_CLIENT_CERT", ""),
+		XrayApiClientKey:    envString("XRAY_API_CLIENT_KEY", ""),
+		XrayApiServerName:   envString("XRAY_API_SERVER_NAME", ""),
+		XrayApiSkipVerify:   envBool("XRAY_API_TLS_SKIP_VERIFY", false),
+		XrayApiProxy:        envString("XRAY_API_PROXY", ""),
+		KeepaliveTime:       envDuration("GRPC_KEEPALIVE_TIME", 30*time.Second),
+		KeepaliveTimeout:    envDuration("GRPC_KEEPALIVE_TIMEOUT", 10*time.Second),
+		KeepaliveNoStream:   envBool("GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM", false),
+		GRPCCompression:     envString("GRPC_COMPRESSION", ""),
+		DialTimeout:         envDuration("DIAL_TIMEOUT", 5*time.Second),
+		WaitForReady:        envBool("GRPC_WAIT_FOR_READY", false),
+		Port:                envPort("PORT", 9100),
+		AdminPort:           envPort("ADMIN_PORT", 0),
+		ScrapeInterval:      envDuration("SCRAPE_INTERVAL", 5*time.Second),
+		FailInterval:        envDuration("FAIL_INTERVAL", 15*time.Second),
+		FailThreshold:       envAnyInt("FAIL_THRESHOLD", 3),
+		FailBackoffMax:      envDuration("FAIL_BACKOFF_MAX", 2*time.Minute),
+		StartupDelay:        envDuration("STARTUP_DELAY", 0),
+		RPCTimeout:          envDuration("RPC_TIMEOUT", 3*time.Second),
+		RPCRetries:          envAnyInt("RPC_RETRIES", 2),
+		RuntimeMetrics:      envBool("ENABLE_RUNTIME_METRICS", true),
+		OnlineIPConcurrency: envInt("ONLINE_IP_CONCURRENCY", 8),
+		OnlineIPSpread:      envInt("ONLINE_IP_SPREAD", 1),
+		StatsCacheTTL:       envDuration("STATS_CACHE_TTL", 0),
+		StatsSoftLimit:      envInt("STATS_SOFT_LIMIT", 0),
+		ShutdownTimeout:     envDuration("SHUTDOWN_TIMEOUT", 5*time.Second),
+		HTTPReadTimeout:     envDuration("HTTP_READ_TIMEOUT", 10*time.Second),
+		HTTPWriteTimeout:    envDuration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		HTTPIdleTimeout:     envDuration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+		TLSCertFile:         envString("TLS_CERT_FILE", ""),
+		TLSKeyFile:          envString("TLS_KEY_FILE", ""),
+		MetricsUsername:     envString("METRICS_USERNAME", ""),
+		MetricsPassword:     envString("METRICS_PASSWORD", ""),
+		MetricsPath:         envString("METRICS_PATH", "/metrics"),
+		MetricsAllowCIDRs:   envList("METRICS_ALLOW_CIDRS", nil),
+		TrustProxy:          envBool("TRUST_PROXY", false),
+		BindAddress:         strings.Trim(envString("BIND_ADDRESS", ""), "[]"),
+		LogLevel:            envString("LOG_LEVEL", "info"),
+		LogFormat:           envString("LOG_FORMAT", "text"),
+		LogHTTPRequests:     envBool("LOG_HTTP_REQUESTS", false),
+		ResetTraffic:        envBool("RESET_TRAFFIC", false),
+		ResetSchedule:       envString("RESET_SCHEDULE", ""),
+		MaxIPsPerUser:       envInt("MAX_IPS_PER_USER", 0),
+		GeoIPDB:             envString("GEOIP_DB", ""),
+		ReverseDNS:          envBool("ENABLE_REVERSE_DNS", false),
+		ReverseDNSTTL:       envDuration("REVERSE_DNS_TTL", time.Hour),
+		IPMask:              envList("IP_MASK", nil),
+		UserIncludeRegex:    envString("USER_INCLUDE_REGEX", ""),
+		UserExcludeRegex:    envString("USER_EXCLUDE_REGEX", ""),
+		UserAliasFile:       envString("USER_ALIAS_FILE", ""),
+		XrayConfigFile:      envString("XRAY_CONFIG_FILE", ""),
+		TrafficEnabled:      envBool("ENABLE_TRAFFIC", true),
+		TrafficTypeDeny:     envList("TRAFFIC_TYPE_DENY", nil),
+		IncludeZeroTraffic:  envBool("INCLUDE_ZERO_TRAFFIC", false),
+		DirectionMapping:    envList("DIRECTION_MAPPING", nil),
+		OnlineUsersEnabled:  envBool("ENABLE_ONLINE_USERS", true),
+		UpFromConnection:    envBool("XRAY_UP_FROM_CONNECTION", false),
+		RateMetrics:         envBool("ENABLE_RATE_METRICS", false),
+		UserTotals:          envBool("ENABLE_USER_TOTALS", false),
+		SplitTraffic:        envBool("ENABLE_SPLIT_TRAFFIC", false),
+		TrafficTotals:       envBool("ENABLE_TRAFFIC_TOTALS", false),
+		Exemplars:           envBool("ENABLE_EXEMPLARS", false),
+		ConfigEndpoint:      envBool("ENABLE_CONFIG_ENDPOINT", false),
+		JSONEndpoint:        envBool("ENABLE_JSON_ENDPOINT", false),
+		ManualScrape:        envBool("ENABLE_MANUAL_SCRAPE", false),
+		DebugScrapes:        envBool("ENABLE_DEBUG_SCRAPES", false),
+		Pprof:               envBool("ENABLE_PPROF", false),
+		PushgatewayURL:      envString("PUSHGATEWAY_URL", ""),
+		PushgatewayJob:      envString("PUSHGATEWAY_JOB", "xray-exporter"),
+		PushgatewayGrouping: envList("PUSHGATEWAY_GROUPING", nil),
+		OTLPEndpoint:        envString("OTLP_ENDPOINT", ""),
+		OTLPInsecure:        envBool("OTLP_INSECURE", false),
+		MetricsEndpoint:     envBool("ENABLE_METRICS_ENDPOINT", true),
+		MetricNamespace:     envString("METRIC_NAMESPACE", "xray"),
+		InstanceLabel:       envString("XRAY_INSTANCE_LABEL", ""),
+	}
+	cfg.loadErr = errors.Join(loadErr, unknownFileSettings())
+	return cfg
+}
+
+// ListenAddr joins BindAddress and Port, bracketing IPv6 hosts.
+func (c *Config) ListenAddr() string {
+	return net.JoinHostPort(c.BindAddress, strconv.Itoa(int(c.Port)))
+}
+
+// AdminAddr is the loopback address of the ADMIN_PORT listener.
+func (c *Config) AdminAddr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(c.AdminPort)))
+}
+
+// metricNamespaceRe matches the namespaces that keep metric names valid in
+// the classic Prometheus format.
+var metricNamespaceRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Validate rejects inconsistent settings and warns about questionable ones.
+func (c *Config) Validate() error {
+	if c.loadErr != nil {
+		return c.loadErr
+	}
+	if len(c.XrayApis) == 0 {
+		return errors.New("XRAY_API must list at least one endpoint")
+	}
+	for i, addr := range c.XrayApis {
+		normalized, err := normalizeXrayAPI(addr)
+		if err != nil {
+			return fmt.Errorf("XRAY_API %q: %w", addr, err)
+		}
+		c.XrayApis[i] = normalized
+	}
+	if c.XrayApiServerName != "" && !c.XrayApiTLS {
+		slog.Warn("XRAY_API_SERVER_NAME has no effect without XRAY_API_TLS")
+	}
+	if c.XrayApiSkipVerify && c.XrayApiTLS {
+		slog.Warn("XRAY_API_TLS_SKIP_VERIFY is set, the Xray API certificate is NOT verified and the connection can be intercepted, do not use this in production")
+	}
+	if c.XrayApiProxy != "" {
+		u, err := url.Parse(c.XrayApiProxy)
+		if err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+			return fmt.Errorf("XRAY_API_PROXY %q must be a socks5://host:port URL", c.XrayApiProxy)
 		}
-		return "127.0.0.1:8080"
-	}(),
-	Port: func() uint16 {
-		if v := os.Getenv("PORT"); v != "" {
-			if p, err := strconv.ParseUint(v, 10, 16); err == nil {
-				return uint16(p)
+	}
+	if c.AdminPort != 0 && c.AdminPort == c.Port {
+		return fmt.Errorf("ADMIN_PORT %d must differ from PORT", c.AdminPort)
+	}
+	if c.UpFromConnection && c.OnlineUsersEnabled {
+		slog.Warn("XRAY_UP_FROM_CONNECTION has no effect with ENABLE_ONLINE_USERS, the online IP lookups query Xray anyway")
+	}
+	if c.UpFromConnection && !c.TrafficEnabled {
+		return errors.New("XRAY_UP_FROM_CONNECTION needs ENABLE_TRAFFIC, the traffic collector's QueryStats is the only one left")
+	}
+	if c.ManualScrape && c.MetricsUsername == "" && c.AdminPort == 0 {
+		return errors.New("ENABLE_MANUAL_SCRAPE needs METRICS_USERNAME or ADMIN_PORT, anyone could trigger the online IP lookups otherwise")
+	}
+	if c.Pprof && c.AdminPort == 0 {
+		return errors.New("ENABLE_PPROF needs ADMIN_PORT, profiles are not served on the metrics port")
+	}
+	if c.FailThreshold < 1 {
+		return fmt.Errorf("FAIL_THRESHOLD %d must be at least 1", c.FailThreshold)
+	}
+	if c.FailBackoffMax < c.FailInterval {
+		slog.Warn("FAIL_BACKOFF_MAX is smaller than FAIL_INTERVAL, failing instances are retried every FAIL_INTERVAL", "fail_backoff_max", c.FailBackoffMax, "fail_interval", c.FailInterval)
+	}
+	if c.GRPCCompression != "" && c.GRPCCompression != gzip.Name {
+		return fmt.Errorf("GRPC_COMPRESSION %q must be empty or gzip", c.GRPCCompression)
+	}
+	if c.RPCRetries < 0 {
+		return fmt.Errorf("RPC_RETRIES %d must not be negative", c.RPCRetries)
+	}
+	if c.RPCTimeout > c.ScrapeInterval {
+		slog.Warn("RPC_TIMEOUT is larger than SCRAPE_INTERVAL", "rpc_timeout", c.RPCTimeout, "scrape_interval", c.ScrapeInterval)
+	}
+	if c.HTTPWriteTimeout < c.RPCTimeout {
+		slog.Warn("HTTP_WRITE_TIMEOUT is smaller than RPC_TIMEOUT, slow scrapes will be cut off", "http_write_timeout", c.HTTPWriteTimeout, "rpc_timeout", c.RPCTimeout)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if (c.MetricsUsername == "") != (c.MetricsPassword == "") {
+		return errors.New("METRICS_USERNAME and METRICS_PASSWORD must be set together")
+	}
+	if !strings.HasPrefix(c.MetricsPath, "/") {
+		return fmt.Errorf("METRICS_PATH %q must start with /", c.MetricsPath)
+	}
+	if slices.Contains(reservedPaths, c.MetricsPath) || strings.HasPrefix(c.MetricsPath, "/debug/") {
+		return fmt.Errorf("METRICS_PATH %q is served by the exporter itself, pick another path", c.MetricsPath)
+	}
+
+	for _, typ := range c.TrafficTypeDeny {
+		if _, known := knownTrafficTypes[typ]; !known {
+			return fmt.Errorf("TRAFFIC_TYPE_DENY %q must be inbound, outbound or user", typ)
+		}
+	}
+	c.directions = nil
+	seen := make(map[string]bool)
+	for _, kv := range c.DirectionMapping {
+		from, to, ok := strings.Cut(kv, "=")
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("DIRECTION_MAPPING %q must be direction=label", kv)
+		}
+		if seen[to] {
+			return fmt.Errorf("DIRECTION_MAPPING maps several directions to %q", to)
+		}
+		seen[to] = true
+		if c.directions == nil {
+			c.directions = make(map[string]string)
+		}
+		c.directions[from] = to
+	}
+	for from, to := range c.directions {
+		// A direction left as it is keeps its own label
+		if _, remapped := c.directions[to]; slices.Contains(knownDirections, to) && to != from && !remapped {
+			return fmt.Errorf("DIRECTION_MAPPING maps %q to the direction %q, which isn't mapped itself", from, to)
+		}
+	}
+	if !metricNamespaceRe.MatchString(c.MetricNamespace) {
+		return fmt.Errorf("METRIC_NAMESPACE %q must be a valid metric name prefix", c.MetricNamespace)
+	}
+	if !c.MetricsEndpoint && c.PushgatewayURL == "" && c.OTLPEndpoint == "" {
+		return errors.New("ENABLE_METRICS_ENDPOINT=false needs PUSHGATEWAY_URL or OTLP_ENDPOINT")
+	}
+	for _, kv := range c.PushgatewayGrouping {
+		name, _, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("PUSHGATEWAY_GROUPING %q must be name=value", kv)
+		}
+		// The pusher refuses grouping labels the pushed metrics already carry
+		if name == "instance" || name == "job" || (name == "server" && c.InstanceLabel != "") {
+			return fmt.Errorf("PUSHGATEWAY_GROUPING can't set the %s label", name)
+		}
+	}
+
+	c.allowedNets = nil
+	for _, cidr := range c.MetricsAllowCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			// A bare address allows just that host
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return fmt.Errorf("METRICS_ALLOW_CIDRS: %w", err)
 			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		c.allowedNets = append(c.allowedNets, prefix.Masked())
+	}
+
+	if len(c.IPMask) > 2 {
+		return fmt.Errorf("IP_MASK %q takes an IPv4 and an IPv6 prefix length", strings.Join(c.IPMask, ","))
+	}
+	c.ipMaskBits = [2]int{}
+	for i, mask := range c.IPMask {
+		family, maxBits := [2]string{"IPv4", "IPv6"}[i], [2]int{32, 128}[i]
+		bits, err := strconv.Atoi(strings.TrimPrefix(mask, "/"))
+		if err != nil || bits < 1 || bits > maxBits {
+			return fmt.Errorf("IP_MASK %q: %s prefix length must be 1 to %d", mask, family, maxBits)
+		}
+		c.ipMaskBits[i] = bits
+	}
+
+	var err error
+	if c.UserIncludeRegex != "" {
+		if c.userInclude, err = regexp.Compile(c.UserIncludeRegex); err != nil {
+			return fmt.Errorf("USER_INCLUDE_REGEX: %w", err)
+		}
+	}
+	if c.UserExcludeRegex != "" {
+		if c.userExclude, err = regexp.Compile(c.UserExcludeRegex); err != nil {
+			return fmt.Errorf("USER_EXCLUDE_REGEX: %w", err)
+		}
+	}
+	if c.UserAliasFile != "" {
+		if c.userAliases, err = loadUserAliases(c.UserAliasFile); err != nil {
+			return err
+		}
+	}
+	if c.XrayConfigFile != "" {
+		if c.tagNames, err = loadTagNames(c.XrayConfigFile); err != nil {
+			return err
+		}
+	}
+	if c.ResetSchedule != "" {
+		if c.ResetTraffic {
+			return errors.New("RESET_SCHEDULE can't be combined with RESET_TRAFFIC, which already resets on every query")
+		}
+		if c.resetSchedule, err = cron.ParseStandard(c.ResetSchedule); err != nil {
+			return fmt.Errorf("RESET_SCHEDULE: %w", err)
+		}
+	}
+	return nil
+}
+
+// defaultXrayAPIPort is appended to XRAY_API addresses without a port.
+const defaultXrayAPIPort = "8080"
+
+// normalizeXrayAPI checks that addr is a Unix socket, a host with an
+// optional port or a dns:// or passthrough:// gRPC target, and appends the
+// default port to a bare host.
+func normalizeXrayAPI(addr string) (string, error) {
+	if path, ok := unixSocketPath(addr); ok {
+		if path == "" || !strings.HasPrefix(path, "/") {
+			return "", errors.New("unix socket path must be absolute")
+		}
+		return addr, nil
+	}
+	if scheme, _, ok := strings.Cut(addr, "://"); ok {
+		if scheme != "dns" && scheme != "passthrough" {
+			return "", fmt.Errorf("unsupported scheme %q, use host:port, a unix:// socket or a dns:// target", scheme)
+		}
+		if _, err := url.Parse(addr); err != nil {
+			return "", err
+		}
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// A bare host, only IPv6 addresses may contain colons then
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), defaultXrayAPIPort
+		if _, ipErr := netip.ParseAddr(host); strings.Contains(host, ":") && ipErr != nil {
+			return "", errors.New("expected host:port")
+		}
+	}
+	if host == "" || strings.ContainsAny(host, " /[]") {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// UserAllowed applies the user include/exclude filters, exclude wins when
+// both match. The regexes are compiled by Validate.
+func (c *Config) UserAllowed(user string) bool {
+	return c.UserFilterReason(user) == ""
+}
+
+// UserFilterReason tells why the user filters drop user, exclude or
+// not_included, and is empty for users that pass them.
+func (c *Config) UserFilterReason(user string) string {
+	if c.userExclude != nil && c.userExclude.MatchString(user) {
+		return "exclude"
+	}
+	if c.userInclude != nil && !c.userInclude.MatchString(user) {
+		return "not_included"
+	}
+	return ""
+}
+
+// MaskIP cuts ip down to its IP_MASK prefix, e.g. 203.0.113.0/24, and
+// returns it as is without a mask for its family or when it doesn't parse.
+func (c *Config) MaskIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := c.ipMaskBits[0]
+	if addr.Is6() {
+		bits = c.ipMaskBits[1]
+	}
+	if bits == 0 || bits == addr.BitLen() {
+		return ip
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// DirectionLabel returns the direction label value for the Xray direction
+// token, the token itself unless DIRECTION_MAPPING renames it.
+func (c *Config) DirectionLabel(direction string) string {
+	if label, ok := c.directions[direction]; ok {
+		return label
+	}
+	return direction
+}
+
+// reservedPaths are the endpoints of the exporter METRICS_PATH can't take,
+// /debug/ and everything below it included.
+var reservedPaths = []string{"/healthz", "/readyz", "/metrics.json", "/scrape", "/config", "/debug"}
+
+// redactedFields are the settings Redacted hides, paths to keys included
+// since they point at where the secrets live, and the proxy, Pushgateway and
+// OTLP URLs since they may carry user:password@.
+var redactedFields = []string{"MetricsPassword", "TLSKeyFile", "XrayApiClientKey", "XrayApiProxy", "PushgatewayURL", "OTLPEndpoint"}
+
+// Redacted returns the exported settings keyed by field name for the
+// /config endpoint, with secrets replaced and durations in readable form.
+func (c *Config) Redacted() map[string]any {
+	settings := make(map[string]any)
+	v := reflect.ValueOf(*c)
+	for _, field := range reflect.VisibleFields(v.Type()) {
+		if !field.IsExported() {
+			continue
+		}
+		switch value := v.FieldByIndex(field.Index).Interface().(type) {
+		case time.Duration:
+			settings[field.Name] = value.String()
+		case string:
+			if value != "" && slices.Contains(redactedFields, field.Name) {
+				settings[field.Name] = "REDACTED"
+			} else {
+				settings[field.Name] = value
+			}
+		default:
+			settings[field.Name] = value
+		}
+	}
+	return settings
+}
+
+// ================= ENV FILE =================
+
+var (
+	// startupEnv holds the keys present in the real environment, they take
+	// precedence over ENV_FILE.
+	startupEnv = func() map[string]bool {
+		keys := make(map[string]bool)
+		for _, kv := range os.Environ() {
+			key, _, _ := strings.Cut(kv, "=")
+			keys[key] = true
+		}
+		return keys
+	}()
+	// envFileKeys are the keys set from ENV_FILE by the previous load, so
+	// entries removed from the file are unset again on reload.
+	envFileKeys = make(map[string]bool)
+)
+
+// applyEnvFile loads KEY=VALUE lines from path into the process environment.
+// Blank lines and lines starting with # are ignored.
+func applyEnvFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ENV_FILE: %w", err)
+	}
+
+	values := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("ENV_FILE %s:%d: expected KEY=VALUE", path, n+1)
+		}
+		values[key] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+
+	for key := range envFileKeys {
+		if _, ok := values[key]; !ok {
+			_ = os.Unsetenv(key)
+			delete(envFileKeys, key)
+		}
+	}
+	for key, value := range values {
+		if startupEnv[key] {
+			continue
+		}
+		_ = os.Setenv(key, value)
+		envFileKeys[key] = true
+	}
+	return nil
+}
+
+// ================= CONFIG FILE =================
+
+var (
+	// fileSettings holds CONFIG_FILE keyed by environment variable name,
+	// usedSettings records which of them loadConfig looked up.
+	fileSettings map[string]string
+	usedSettings map[string]bool
+)
+
+// loadConfigFile reads a YAML file whose keys are the environment variable
+// names in lower case, e.g. scrape_interval: 10s. Lists are joined with
+// commas so xray_apis can be written as a YAML sequence.
+func loadConfigFile(path string) error {
+	fileSettings = make(map[string]string)
+	usedSettings = make(map[string]bool)
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("CONFIG_FILE %s: %w", path, err)
+	}
+
+	for key, value := range raw {
+		name := strings.ToUpper(key)
+		switch v := value.(type) {
+		case nil:
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			fileSettings[name] = strings.Join(items, ",")
+		case map[string]any:
+			return fmt.Errorf("CONFIG_FILE %s: %s must be a scalar or a list", path, key)
+		default:
+			fileSettings[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// unknownFileSettings reports CONFIG_FILE keys that match no setting, which
+// are almost always typos.
+func unknownFileSettings() error {
+	var unknown []string
+	for name := range fileSettings {
+		if !usedSettings[name] {
+			unknown = append(unknown, strings.ToLower(name))
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	slices.Sort(unknown)
+	return fmt.Errorf("CONFIG_FILE: unknown settings %s", strings.Join(unknown, ", "))
+}
+
+// ================= FLAGS =================
+
+// settingFlags are the command-line flags overriding a setting, named after
+// the environment variable they replace.
+var settingFlags = []struct{ name, key string }{
+	{"xray-api", "XRAY_APIS"},
+	{"port", "PORT"},
+	{"bind-address", "BIND_ADDRESS"},
+	{"metrics-path", "METRICS_PATH"},
+	{"scrape-interval", "SCRAPE_INTERVAL"},
+	{"fail-interval", "FAIL_INTERVAL"},
+	{"rpc-timeout", "RPC_TIMEOUT"},
+	{"stats-cache-ttl", "STATS_CACHE_TTL"},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT"},
+}
+
+// flagSettings holds the setting flags given on the command line, they win
+// over the environment and the config files.
+var flagSettings = make(map[string]string)
+
+// defineSettingFlags adds settingFlags to fs.
+func defineSettingFlags(fs *flag.FlagSet) {
+	for _, f := range settingFlags {
+		fs.String(f.name, "", "overrides "+f.key)
+	}
+}
+
+// applySettingFlags records the setting flags that were set on the parsed fs
+// and reports whether there were any.
+func applySettingFlags(fs *flag.FlagSet) bool {
+	fs.Visit(func(set *flag.Flag) {
+		for _, f := range settingFlags {
+			if f.name == set.Name {
+				flagSettings[f.key] = set.Value.String()
+			}
+		}
+	})
+	return len(flagSettings) > 0
+}
+
+// lookupSetting returns the flag or environment variable for key, or the
+// CONFIG_FILE value when neither is set.
+func lookupSetting(key string) string {
+	usedSettings[key] = true
+	if v := flagSettings[key]; v != "" {
+		return v
+	}
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fileSettings[key]
+}
+
+// ================= ENV HELPERS =================
+
+func envString(key, def string) string {
+	if v := lookupSetting(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envPort(key string, def uint16) uint16 {
+	if v := lookupSetting(key); v != "" {
+		if p, err := strconv.ParseUint(v, 10, 16); err == nil {
+			return uint16(p)
+		}
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	if v := lookupSetting(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := lookupSetting(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v := lookupSetting(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// envAnyInt is envInt without the positive check, so Validate can reject
+// out of range values instead of silently using the default.
+func envAnyInt(key string, def int) int {
+	if v := lookupSetting(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// envList splits a comma-separated value, dropping empty entries.
+func envList(key string, def []string) []string {
+	v := lookupSetting(key)
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
 		}
-		return 9100
-	}(),
+	}
+	return list
 }
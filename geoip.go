@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// ================= GEOIP =================
+
+// geoDB is opened once at startup when GEOIP_DB is set and stays nil otherwise.
+var geoDB *geoip2.Reader
+
+func loadGeoIP(path string) error {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return err
+	}
+	geoDB = db
+	return nil
+}
+
+// ipCountry returns the ISO country code of ip, "private" for addresses that
+// are not routable on the internet and "unknown" when the lookup fails.
+func ipCountry(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "unknown"
+	}
+	addr = addr.Unmap()
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return "private"
+	}
+
+	record, err := geoDB.Country(net.IP(addr.AsSlice()))
+	if err != nil || record.Country.IsoCode == "" {
+		return "unknown"
+	}
+	return record.Country.IsoCode
+}
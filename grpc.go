@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// ================= GRPC DIAL =================
+
+func dialXray(cfg *Config, addr string) (*grpc.ClientConn, error) {
+	creds, err := transportCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithChainUnaryInterceptor(rpcRetryInterceptor(addr), rpcLoggingInterceptor, rpcDurationInterceptor(addr)),
+		// Ping the connection so a silently dropped link fails the
+		// transport instead of hanging until the RPC times out
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                cfg.KeepaliveTime,
+			Timeout:             cfg.KeepaliveTimeout,
+			PermitWithoutStream: cfg.KeepaliveNoStream,
+		}),
+	}
+
+	if cfg.GRPCCompression != "" {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(cfg.GRPCCompression)))
+	}
+	if cfg.WaitForReady {
+		// Calls wait out a reconnect within their deadline instead of
+		// failing fast while the connection is down
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.WaitForReady(true)))
+	}
+
+	target := addr
+	if path, ok := unixSocketPath(addr); ok {
+		// The dialer ignores the resolved address, the target only sets the authority
+		target = "passthrough:///localhost"
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}))
+	} else if cfg.XrayApiProxy != "" {
+		dialer, err := proxyDialer(cfg.XrayApiProxy)
+		if err != nil {
+			return nil, err
+		}
+		// Passthrough hands the address to the proxy unresolved, so names
+		// only the far side knows still work
+		if !strings.Contains(addr, "://") {
+			target = "passthrough:///" + addr
+		}
+		opts = append(opts, grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", address)
+		}))
+	}
+
+	return grpc.NewClient(target, opts...)
+}
+
+// proxyDialer returns a dialer connecting through the SOCKS5 proxy at
+// rawURL, socks5://[user:password@]host:port.
+func proxyDialer(rawURL string) (proxy.ContextDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("XRAY_API_PROXY: %w", err)
+	}
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("XRAY_API_PROXY: %w", err)
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("XRAY_API_PROXY: %s proxies can't be cancelled", u.Scheme)
+	}
+	return cd, nil
+}
+
+// rpcDurationInterceptor observes xray_api_rpc_duration_seconds for every
+// call made on the connection to addr.
+func rpcDurationInterceptor(addr string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		xrayAPIRPCDuration.WithLabelValues(addr, path.Base(method)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// rpcRetryBackoff is the pause before the first retry, it doubles after
+// every further attempt.
+const rpcRetryBackoff = 100 * time.Millisecond
+
+// rpcRetryInterceptor retries calls that failed with a transient error up to
+// RPC_RETRIES times. Every attempt shares the caller's context, so retries
+// stay within its RPC_TIMEOUT and stop once the next pause would not fit.
+// A QueryStats with Reset_ set is never retried: Xray may have zeroed the
+// counters before the response got lost, and a retry would read them near
+// zero and drop that traffic. The caller keeps its previous state instead.
+func rpcRetryInterceptor(addr string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		retries := AppConfig().RPCRetries
+		if query, ok := req.(*statsService.QueryStatsRequest); ok && query.Reset_ {
+			retries = 0
+		}
+		backoff := rpcRetryBackoff
+		for attempt := 1; ; attempt++ {
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			if err == nil || attempt > retries || !retryableRPCError(err) || ctx.Err() != nil {
+				return err
+			}
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+				return err
+			}
+
+			slog.Debug("Retrying Xray API call", "instance", addr, "method", path.Base(method), "attempt", attempt, "error", err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// retryableRPCError reports whether err is worth another attempt. A
+// DeadlineExceeded caused by the caller's own context is filtered out by
+// rpcRetryInterceptor before this matters.
+func retryableRPCError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// unixSocketPath reports whether addr refers to a Unix domain socket,
+// either as unix:///path/to/sock or as a bare absolute path.
+func unixSocketPath(addr string) (string, bool) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		return path, true
+	}
+	if strings.HasPrefix(addr, "/") {
+		return addr, true
+	}
+	return "", false
+}
+
+func transportCredentials(cfg *Config) (credentials.TransportCredentials, error) {
+	if !cfg.XrayApiTLS {
+		return insecure.NewCredentials(), nil
+	}
+
+	// An empty ServerName verifies the certificate against the dialed host
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.XrayApiServerName,
+		InsecureSkipVerify: cfg.XrayApiSkipVerify,
+	}
+
+	// nil RootCAs falls back to the system cert pool
+	if cfg.XrayApiCAFile != "" {
+		pem, err := os.ReadFile(cfg.XrayApiCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file %s: %w", cfg.XrayApiCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates in CA file %s", cfg.XrayApiCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (cfg.XrayApiClientCert == "") != (cfg.XrayApiClientKey == "") {
+		return nil, fmt.Errorf("XRAY_API_CLIENT_CERT and XRAY_API_CLIENT_KEY must be set together")
+	}
+	if cfg.XrayApiClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.XrayApiClientCert, cfg.XrayApiClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// ================= RECONNECTING CLIENT =================
+
+const (
+	// reconnectThreshold is the number of consecutive bad state checks
+	// before the connection is recreated.
+	reconnectThreshold  = 3
+	reconnectBackoffMin = time.Second
+	reconnectBackoffMax = time.Minute
+)
+
+// reconnectingClient implements statsService.StatsServiceClient on top of a
+// gRPC connection that is recreated when it stays in a failed state.
+type reconnectingClient struct {
+	cfg  *Config
+	addr string
+
+	mu          sync.RWMutex
+	conn        *grpc.ClientConn
+	client      statsService.StatsServiceClient
+	badChecks   int
+	backoff     time.Duration
+	nextAttempt time.Time
+}
+
+// xrayConn is the connection side of an Xray client that the scrape loop
+// and the instance set rely on, reconnectingClient implements it.
+type xrayConn interface {
+	CheckState() connectivity.State
+	WaitReady(ctx context.Context) bool
+	Redial(cfg *Config)
+	Close() error
+}
+
+func newReconnectingClient(cfg *Config, addr string) (*reconnectingClient, error) {
+	conn, err := dialXray(cfg, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &reconnectingClient{
+		cfg:    cfg,
+		addr:   addr,
+		conn:   conn,
+		client: statsService.NewStatsServiceClient(conn),
+	}, nil
+}
+
+func (c *reconnectingClient) current() statsService.StatsServiceClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client
+}
+
+func (c *reconnectingClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// WaitReady connects and blocks until the connection is ready or ctx is
+// done, reporting whether it became ready.
+func (c *reconnectingClient) WaitReady(ctx context.Context) bool {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return true
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return false
+		}
+	}
+}
+
+// CheckState returns the current connectivity state and recreates the
+// connection, with exponential backoff, once it has been failing for
+// reconnectThreshold consecutive checks.
+func (c *reconnectingClient) CheckState() connectivity.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.conn.GetState()
+	switch state {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		c.badChecks++
+	case connectivity.Ready:
+		c.badChecks = 0
+		c.backoff = 0
+		return state
+	default:
+		c.badChecks = 0
+		return state
+	}
+
+	if c.badChecks < reconnectThreshold || time.Now().Before(c.nextAttempt) {
+		return state
+	}
+
+	c.backoff = min(max(c.backoff*2, reconnectBackoffMin), reconnectBackoffMax)
+	c.nextAttempt = time.Now().Add(c.backoff)
+
+	slog.Info("Reconnecting to Xray", "instance", c.addr, "state", state, "backoff", c.backoff)
+	conn, err := dialXray(c.cfg, c.addr)
+	if err != nil {
+		slog.Error("Reconnect to Xray failed", "instance", c.addr, "error", err)
+		return state
+	}
+
+	old := c.conn
+	c.conn = conn
+	c.client = statsService.NewStatsServiceClient(conn)
+	c.badChecks = 0
+	_ = old.Close()
+
+	conn.Connect()
+	return conn.GetState()
+}
+
+// Redial replaces the connection when cfg changes how it is dialed, and
+// otherwise only adopts cfg for future reconnects.
+func (c *reconnectingClient) Redial(cfg *Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	same := dialSettingsEqual(c.cfg, cfg)
+	c.cfg = cfg
+	if same {
+		return
+	}
+
+	slog.Info("Xray connection settings changed, reconnecting", "instance", c.addr)
+	conn, err := dialXray(cfg, c.addr)
+	if err != nil {
+		slog.Error("Reconnect to Xray failed", "instance", c.addr, "error", err)
+		return
+	}
+	old := c.conn
+	c.conn = conn
+	c.client = statsService.NewStatsServiceClient(conn)
+	c.badChecks = 0
+	c.backoff = 0
+	_ = old.Close()
+}
+
+// dialSettingsEqual reports whether a and b dial Xray the same way.
+func dialSettingsEqual(a, b *Config) bool {
+	return a.XrayApiTLS == b.XrayApiTLS &&
+		a.XrayApiCAFile == b.XrayApiCAFile &&
+		a.XrayApiClientCert == b.XrayApiClientCert &&
+		a.XrayApiClientKey == b.XrayApiClientKey &&
+		a.XrayApiServerName == b.XrayApiServerName &&
+		a.XrayApiSkipVerify == b.XrayApiSkipVerify &&
+		a.KeepaliveTime == b.KeepaliveTime &&
+		a.KeepaliveTimeout == b.KeepaliveTimeout &&
+		a.KeepaliveNoStream == b.KeepaliveNoStream &&
+		a.GRPCCompression == b.GRPCCompression &&
+		a.WaitForReady == b.WaitForReady &&
+		a.XrayApiProxy == b.XrayApiProxy
+}
+
+func (c *reconnectingClient) GetStats(ctx context.Context, in *statsService.GetStatsRequest, opts ...grpc.CallOption) (*statsService.GetStatsResponse, error) {
+	return c.current().GetStats(ctx, in, opts...)
+}
+
+func (c *reconnectingClient) GetStatsOnline(ctx context.Context, in *statsService.GetStatsRequest, opts ...grpc.CallOption) (*statsService.GetStatsResponse, error) {
+	return c.current().GetStatsOnline(ctx, in, opts...)
+}
+
+func (c *reconnectingClient) QueryStats(ctx context.Context, in *statsService.QueryStatsRequest, opts ...grpc.CallOption) (*statsService.QueryStatsResponse, error) {
+	return c.current().QueryStats(ctx, in, opts...)
+}
+
+func (c *reconnectingClient) GetSysStats(ctx context.Context, in *statsService.SysStatsRequest, opts ...grpc.CallOption) (*statsService.SysStatsResponse, error) {
+	return c.current().GetSysStats(ctx, in, opts...)
+}
+
+func (c *reconnectingClient) GetStatsOnlineIpList(ctx context.Context, in *statsService.GetStatsRequest, opts ...grpc.CallOption) (*statsService.GetStatsOnlineIpListResponse, error) {
+	return c.current().GetStatsOnlineIpList(ctx, in, opts...)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRPCRetryInterceptor(t *testing.T) {
+	setTestConfig(t, map[string]string{"RPC_RETRIES": "1"})
+	tests := []struct {
+		name      string
+		req       any
+		wantCalls int
+	}{
+		{"query", &statsService.QueryStatsRequest{}, 2},
+		{"online ip list", &statsService.GetStatsRequest{}, 2},
+		// The reset may have happened, a retry would read zeroed counters
+		{"resetting query", &statsService.QueryStatsRequest{Reset_: true}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			invoker := func(context.Context, string, any, any, *grpc.ClientConn, ...grpc.CallOption) error {
+				calls++
+				return status.Error(codes.Unavailable, "connection reset")
+			}
+			err := rpcRetryInterceptor("test")(context.Background(), "/xray.app.stats.command.StatsService/QueryStats", tt.req, nil, nil, invoker)
+			if status.Code(err) != codes.Unavailable {
+				t.Errorf("err = %v, want Unavailable", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
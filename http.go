@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ================= HTTP HANDLERS =================
+
+const landingPage = `<html>
+<head><title>Xray Exporter</title></head>
+<body>
+<h1>Xray Exporter</h1>
+<p>Version %s</p>
+<p><a href="%s">Metrics</a></p>
+</body>
+</html>
+`
+
+func landingHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, landingPage, Version, AppConfig().MetricsPath)
+}
+
+// healthzHandler reports liveness only; it deliberately ignores Xray
+// reachability so transient API outages don't restart the exporter.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// readyzHandler returns 200 when the last scrape reached at least one Xray
+// instance, so a single dead node doesn't take the whole exporter out of
+// rotation. The body lists the state of every instance.
+func readyzHandler(set *instanceSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		instances := set.List()
+		ready := false
+		states := make(map[string]bool, len(instances))
+		for _, inst := range instances {
+			up := inst.up.Load()
+			states[inst.name] = up
+			ready = ready || up
+		}
+
+		status := http.StatusOK
+		state := "ready"
+		if !ready {
+			status = http.StatusServiceUnavailable
+			state = "xray unreachable"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ready":     ready,
+			"status":    state,
+			"instances": states,
+		})
+	}
+}
+
+// jsonTrafficStat is one xray_traffic_bytes_total series in /metrics.json.
+type jsonTrafficStat struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type jsonInstance struct {
+	Up          bool                `json:"up"`
+	OnlineUsers int                 `json:"online_users"`
+	OnlineIPs   map[string][]string `json:"online_ips,omitempty"`
+	Traffic     []jsonTrafficStat   `json:"traffic,omitempty"`
+}
+
+// metricsJSONHandler serves the main values of every instance as JSON for
+// consumers without a Prometheus parser. It reads the stats cache and the
+// result of the last scrape, so it doesn't add Xray API calls of its own
+// while the cache is fresh.
+func metricsJSONHandler(set *instanceSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := AppConfig()
+		doc := make(map[string]jsonInstance)
+		for _, inst := range set.List() {
+			out := jsonInstance{Up: inst.up.Load()}
+
+			if online := inst.online.Load(); online != nil {
+				out.OnlineIPs = make(map[string][]string, len(*online))
+				for user, ips := range *online {
+					list := slices.AppendSeq(make([]string, 0, len(ips)), maps.Keys(ips))
+					slices.Sort(list)
+					out.OnlineIPs[cfg.UserAlias(user)] = list
+					if len(ips) > 0 {
+						out.OnlineUsers++
+					}
+				}
+			}
+
+			if cfg.TrafficEnabled {
+				stats, err := inst.cache.Get(r.Context())
+				if err != nil {
+					slog.Error("metrics.json error during QueryStats", "instance", inst.name, "error", err)
+				}
+				eachTrafficStat(stats, func(typ, name, direction string, value int64) {
+					out.Traffic = append(out.Traffic, jsonTrafficStat{typ, name, AppConfig().DirectionLabel(direction), value})
+				})
+			}
+			doc[inst.name] = out
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"instances": doc})
+	}
+}
+
+type jsonScrapeResult struct {
+	Up              bool    `json:"up"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// scrapeHandler runs a scrape of every instance right away and reports the
+// outcome, 502 when any of them failed. A scrape already running, scheduled
+// or manual, is waited for instead of overlapped. QueryStats is still served
+// from the stats cache while it is fresh.
+func scrapeHandler(set *instanceSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		doc := make(map[string]jsonScrapeResult)
+		for _, inst := range set.List() {
+			start := time.Now()
+			err := inst.scrape(r.Context())
+			result := jsonScrapeResult{Up: err == nil, DurationSeconds: time.Since(start).Seconds()}
+			if err != nil {
+				result.Error = err.Error()
+				status = http.StatusBadGateway
+			}
+			doc[inst.name] = result
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{"instances": doc})
+	}
+}
+
+// debugScrapesHandler lists the most recent scrapes of every instance,
+// oldest first.
+func debugScrapesHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"scrapes": recentScrapes.list()})
+}
+
+// configHandler serves the effective configuration as JSON with secrets
+// redacted, to check what the env, ENV_FILE and CONFIG_FILE resolved to.
+func configHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(AppConfig().Redacted())
+}
+
+// ================= TRACE CONTEXT =================
+
+type traceIDKey struct{}
+
+// withTraceID stores the trace ID of a W3C traceparent header sent with r in
+// the returned context, for the traffic counter exemplars.
+func withTraceID(r *http.Request) context.Context {
+	// traceparent: version-traceid-parentid-flags
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return r.Context()
+	}
+	return context.WithValue(r.Context(), traceIDKey{}, parts[1])
+}
+
+func traceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// ================= MIDDLEWARE =================
+
+// protect wraps the handlers serving exporter data with the source address
+// allowlist and Basic Auth.
+func protect(cfg *Config, next http.Handler) http.Handler {
+	return allowCIDRs(cfg.allowedNets, cfg.TrustProxy, basicAuth(cfg.MetricsUsername, cfg.MetricsPassword, next))
+}
+
+// allowCIDRs rejects requests from outside nets with 403, it is a no-op when
+// nets is empty. With trustProxy the client is the last X-Forwarded-For
+// address, the one added by the proxy in front of the exporter.
+func allowCIDRs(nets []netip.Prefix, trustProxy bool, next http.Handler) http.Handler {
+	if len(nets) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		if xff := r.Header.Get("X-Forwarded-For"); trustProxy && xff != "" {
+			client = strings.TrimSpace(xff[strings.LastIndex(xff, ",")+1:])
+		}
+
+		addr, err := netip.ParseAddr(client)
+		if err == nil {
+			addr = addr.Unmap()
+			for _, n := range nets {
+				if n.Contains(addr) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
+
+// basicAuth protects next with HTTP Basic Auth, it is a no-op when no
+// username is configured.
+func basicAuth(username, password string, next http.Handler) http.Handler {
+	if username == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="xray-exporter", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRequests logs every request to next with its status and duration when
+// LOG_HTTP_REQUESTS is set, checked per request so a reload toggles it.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !AppConfig().LogHTTPRequests {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		slog.Info("HTTP request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr,
+			"status", rec.status, "duration", time.Since(start))
+	})
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
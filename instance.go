@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+// ================= XRAY INSTANCE =================
+
+// xrayInstance bundles everything the exporter keeps per Xray endpoint. Its
+// name is the configured address and becomes the instance label.
+type xrayInstance struct {
+	name string
+	// client and stats are the same reconnectingClient, split into the
+	// connection and the stats RPCs outside the cache so tests can swap in
+	// fakes for both.
+	client   xrayConn
+	stats    statsService.StatsServiceClient
+	cache    *statsCache
+	rates    trafficRates
+	observed observedTraffic
+	totals   trafficTotals
+
+	// up mirrors xray_up for the readiness probe, it is written by
+	// scrapeLoop and read from HTTP goroutines.
+	up atomic.Bool
+	// online is the user -> IP map of the last scrape, kept for /metrics.json
+	online atomic.Pointer[map[string]map[string]int64]
+	// onlineUnsupported is set once Xray answers GetStatsOnlineIpList with
+	// Unimplemented, online IPs are then skipped until the next reload.
+	onlineUnsupported atomic.Bool
+	// scrapeMu serializes scheduled and manual scrapes, it guards
+	// onlineResults, onlineRefreshed and spreadCycle
+	scrapeMu        sync.Mutex
+	onlineResults   map[string]onlineResult
+	onlineRefreshed map[string]time.Time
+	spreadCycle     int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newXrayInstance(cfg *Config, addr string) (*xrayInstance, error) {
+	client, err := newReconnectingClient(cfg, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Default to one QueryStats per scrape interval
+	cacheTTL := cfg.StatsCacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = cfg.ScrapeInterval
+	}
+
+	return &xrayInstance{
+		name:   addr,
+		client: client,
+		stats:  client,
+		cache:  newStatsCache(client, cacheTTL, cfg.ResetTraffic),
+	}, nil
+}
+
+// start launches the scrape loop of the instance.
+func (i *xrayInstance) start(ctx context.Context) {
+	ctx, i.cancel = context.WithCancel(ctx)
+	i.done = make(chan struct{})
+	go func() {
+		defer close(i.done)
+		scrapeLoop(ctx, i)
+	}()
+}
+
+// scrape runs one scrape cycle, waiting for one already in progress.
+func (i *xrayInstance) scrape(ctx context.Context) error {
+	i.scrapeMu.Lock()
+	defer i.scrapeMu.Unlock()
+	return scrapeOnce(ctx, i)
+}
+
+// stop ends the scrape loop and drops every series carrying this instance
+// label.
+func (i *xrayInstance) stop() {
+	i.cancel()
+	<-i.done
+	deleteInstanceSeries(i.name)
+}
+
+// collectors returns the collectors querying Xray on demand. They are built
+// for every scrape so their RPCs run under ctx, the scrape's context.
+func (i *xrayInstance) collectors(ctx context.Context) []prometheus.Collector {
+	cs := []prometheus.Collector{NewXraySysStatsCollector(ctx, i.stats)}
+	if AppConfig().TrafficEnabled {
+		cs = append(cs, NewXrayTrafficCollector(ctx, i.cache, &i.totals))
+	}
+	return cs
+}
+
+func (i *xrayInstance) Close() error {
+	return i.client.Close()
+}
+
+// ================= INSTANCE SET =================
+
+// instanceSet tracks the running instances so a config reload can add,
+// remove or redial them without restarting the exporter.
+type instanceSet struct {
+	mu        sync.RWMutex
+	instances []*xrayInstance
+}
+
+func newInstanceSet() *instanceSet {
+	return &instanceSet{}
+}
+
+func (s *instanceSet) List() []*xrayInstance {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.instances)
+}
+
+// Sync makes the running instances match cfg.XrayApis. Instances that are
+// kept are redialed when their connection settings changed. New instances
+// are dialed before anything else changes, when one fails the set is left
+// as it was.
+func (s *instanceSet) Sync(ctx context.Context, cfg *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Dial the new endpoints first, so a failure leaves the set as it was
+	var added []*xrayInstance
+	for _, addr := range cfg.XrayApis {
+		if slices.ContainsFunc(s.instances, func(i *xrayInstance) bool { return i.name == addr }) {
+			continue
+		}
+		inst, err := newXrayInstance(cfg, addr)
+		if err != nil {
+			for _, inst := range added {
+				_ = inst.Close()
+			}
+			return err
+		}
+		added = append(added, inst)
+	}
+
+	kept := s.instances[:0]
+	for _, inst := range s.instances {
+		if slices.Contains(cfg.XrayApis, inst.name) {
+			inst.client.Redial(cfg)
+			// Xray may have been upgraded, try the online IP list again
+			inst.onlineUnsupported.Store(false)
+			kept = append(kept, inst)
+			continue
+		}
+		slog.Info("Removing Xray instance", "instance", inst.name)
+		inst.stop()
+		_ = inst.Close()
+	}
+	s.instances = kept
+
+	for _, inst := range added {
+		inst.start(ctx)
+		s.instances = append(s.instances, inst)
+	}
+	return nil
+}
+
+// Gatherer collects the on-demand metrics of every instance, with the
+// instance as a constant label, and cancels their Xray API calls when ctx
+// is done.
+func (s *instanceSet) Gatherer(ctx context.Context) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		reg := prometheus.NewRegistry()
+		for _, inst := range s.List() {
+			labels := prometheus.Labels{"instance": inst.name}
+			maps.Copy(labels, serverLabels)
+			wrapped := prometheus.WrapRegistererWith(labels, reg)
+			for _, c := range inst.collectors(ctx) {
+				if err := wrapped.Register(c); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return reg.Gather()
+	})
+}
+
+// Close stops every instance, used on shutdown.
+func (s *instanceSet) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, inst := range s.instances {
+		inst.stop()
+		_ = inst.Close()
+	}
+	s.instances = nil
+}
@@ -2,220 +2,252 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
-	"strings"
+	"runtime"
 	"syscall"
 	"time"
 
-	statsService "github.com/xtls/xray-core/app/stats/command"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// ================= CONFIG & CONSTANTS =================
-var (
-	scrapeInterval = 5 * time.Second
-	failInterval   = 15 * time.Second
-	rpcTimeout     = 3 * time.Second
-)
-
-// ================= METRICS (Gauge only) =================
-
-var (
-	xrayUserIPOnline = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "xray_user_ip_online",
-			Help: "User online status per IP (1=online)",
-		},
-		[]string{"name", "ip"},
-	)
-
-	xrayUp = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "xray_up",
-			Help: "Whether Xray is reachable (1=up, 0=down)",
-		},
-	)
-)
-
-// ================= TRAFFIC COLLECTOR (CUSTOM) =================
-
-type XrayTrafficCollector struct {
-	client      statsService.StatsServiceClient
-	trafficDesc *prometheus.Desc
-}
-
-func NewXrayTrafficCollector(client statsService.StatsServiceClient) *XrayTrafficCollector {
-	return &XrayTrafficCollector{
-		client: client,
-		trafficDesc: prometheus.NewDesc(
-			"xray_traffic_bytes_total",
-			"Xray traffic statistics",
-			[]string{"type", "name", "direction"},
-			nil,
-		),
-	}
-}
-
-func (c *XrayTrafficCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.trafficDesc
-}
-
-func (c *XrayTrafficCollector) Collect(ch chan<- prometheus.Metric) {
-	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
-	defer cancel()
+// ================= MAIN =================
 
-	resp, err := c.client.QueryStats(ctx, &statsService.QueryStatsRequest{
-		Pattern: "",
-		Reset_:  false,
-	})
-	if err != nil {
-		log.Printf("TrafficCollector error during QueryStats: %v", err)
+func main() {
+	check := flag.Bool("check", false, "check /healthz of a running exporter and exit 0 or 1")
+	version := flag.Bool("version", false, "print the version and exit")
+	oneshot := flag.Bool("oneshot", false, "scrape once, print the metrics to stdout and exit, 1 when the scrape failed")
+	defineSettingFlags(flag.CommandLine)
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("xray-exporter %s (commit %s, %s)\n", Version, Commit, runtime.Version())
 		return
 	}
-
-	for _, stat := range resp.Stat {
-		if stat.Value == 0 {
-			continue
-		}
-		if strings.Contains(stat.Name, ">>>traffic>>>") {
-			parts := strings.Split(stat.Name, ">>>")
-			if len(parts) < 4 {
-				continue
-			}
-			typ := parts[0]
-			nameLabel := parts[1]
-			direction := parts[3]
-
-			ch <- prometheus.MustNewConstMetric(
-				c.trafficDesc,
-				prometheus.CounterValue,
-				float64(stat.Value),
-				typ, nameLabel, direction,
-			)
-		}
+	if applySettingFlags(flag.CommandLine) {
+		appConfig.Store(loadConfig())
 	}
-}
 
-// ================= MAIN =================
+	cfg := AppConfig()
+	if *check {
+		os.Exit(runHealthCheck(cfg))
+	}
+	setupLogger(cfg)
+	slog.Info("Starting Xray exporter", "version", Version)
 
-func main() {
-	log.Printf("Starting Xray exporter %s...\n", Version)
+	if err := cfg.Validate(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
 
-	conn, err := grpc.NewClient(AppConfig.XrayApi, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		log.Fatal("Connect to Xray failed:", err)
+	if cfg.GeoIPDB != "" {
+		if err := loadGeoIP(cfg.GeoIPDB); err != nil {
+			fatal("Load GeoIP database failed", "path", cfg.GeoIPDB, "error", err)
+		}
+		defer geoDB.Close()
 	}
-	defer conn.Close()
-	client := statsService.NewStatsServiceClient(conn)
 
 	reg := prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(serverLabels, reg)
+
+	registerer.MustRegister(xrayTrafficRate)
+	registerer.MustRegister(xrayObservedBytes)
+	registerer.MustRegister(xrayUserIPOnline)
+	registerer.MustRegister(xrayUserOnlineIPCount)
+	registerer.MustRegister(xrayUserOnlineIPDistribution)
+	registerer.MustRegister(xrayUserOnlineIPAge)
+	registerer.MustRegister(xrayUserOnlineIPErrors)
+	registerer.MustRegister(xrayOnlineUsers)
+	registerer.MustRegister(xrayOnlineIPs)
+	registerer.MustRegister(xrayOnlineIPsMaxAge)
+	registerer.MustRegister(xrayOnlineIPsAvg)
+	registerer.MustRegister(xrayOnlineIPsMax)
+	registerer.MustRegister(xrayOnlineIPWorkers)
+	registerer.MustRegister(xrayUp)
+	registerer.MustRegister(xrayStatsReturned)
+	registerer.MustRegister(xrayStatsUsers)
+	registerer.MustRegister(xrayUsersFiltered)
+	registerer.MustRegister(xrayStatsProcessed)
+	registerer.MustRegister(xrayScrapeDuration)
+	registerer.MustRegister(xrayScrapeErrors)
+	registerer.MustRegister(xrayScrapeLastError)
+	registerer.MustRegister(xrayScrapePartial)
+	registerer.MustRegister(xrayLastScrapeSuccess)
+	registerer.MustRegister(xrayScrapeInterval)
+	registerer.MustRegister(xrayAPIRPCDuration)
+	registerer.MustRegister(xrayAPIConnectionState)
+	registerer.MustRegister(xrayExporterBuildInfo)
+	registerer.MustRegister(xrayExporterStartTime)
+	registerer.MustRegister(xrayConfigReloads)
+	registerer.MustRegister(xrayConfigLastReloadSuccess)
+	registerer.MustRegister(xrayConfigLastReloadSuccessTime)
+
+	if cfg.RuntimeMetrics {
+		registerer.MustRegister(collectors.NewGoCollector())
+		registerer.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
 
-	trafficCollector := NewXrayTrafficCollector(client)
-	reg.MustRegister(trafficCollector)
-
-	reg.MustRegister(xrayUserIPOnline)
-	reg.MustRegister(xrayUp)
+	xrayExporterBuildInfo.WithLabelValues(Version, runtime.Version(), Commit).Set(1)
+	xrayExporterStartTime.Set(float64(time.Now().Unix()))
+	// The configuration loaded at startup counts as a successful load
+	xrayConfigLastReloadSuccess.Set(1)
+	xrayConfigLastReloadSuccessTime.Set(float64(time.Now().Unix()))
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	go scrapeLoop(ctx, client)
+	if *oneshot {
+		os.Exit(runOneshot(ctx, cfg, reg))
+	}
 
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-	addr := fmt.Sprintf(":%d", AppConfig.Port)
-	log.Printf("Exporter listening on %s/metrics\n", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
-}
+	instances := newInstanceSet()
+	if err := instances.Sync(ctx, cfg); err != nil {
+		fatal("Connect to Xray failed", "error", err)
+	}
+	defer instances.Close()
 
-// ================= SCRAPE LOOP & FUNCTIONS =================
-
-func scrapeLoop(ctx context.Context, client statsService.StatsServiceClient) {
-	log.Println("Scrape loop started (single-thread mode)")
-
-	failCount := 0
-
-	time.Sleep(2 * time.Second)
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Scrape loop stopped")
-			return
-		default:
-			err := scrapeOnlineUsersAndHealth(client)
-			if err != nil {
-				failCount++
-				xrayUp.Set(0)
-				log.Println("scrapeOnlineUsersAndHealth error:", err)
-			} else {
-				failCount = 0
-				xrayUp.Set(1)
-			}
+	go reloadOnSIGHUP(ctx, instances)
+	if cfg.resetSchedule != nil {
+		go resetOnSchedule(ctx, cfg, instances)
+	}
 
-			sleep := scrapeInterval
-			if failCount >= 3 {
-				sleep = failInterval
-			}
-			time.Sleep(sleep)
-		}
+	if cfg.PushgatewayURL != "" {
+		go pushLoop(ctx, cfg, prometheus.Gatherers{reg, instances.Gatherer(ctx)})
 	}
-}
 
-func scrapeOnlineUsersAndHealth(c statsService.StatsServiceClient) error {
-	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
-	defer cancel()
+	var shutdownOTLP func(context.Context) error
+	if cfg.OTLPEndpoint != "" {
+		var err error
+		if shutdownOTLP, err = startOTLP(ctx, cfg, prometheus.Gatherers{reg, instances.Gatherer(ctx)}); err != nil {
+			fatal("Start OTLP export failed", "error", err)
+		}
+		slog.Info("Exporting metrics over OTLP", "endpoint", cfg.OTLPEndpoint)
+	}
 
-	resp, err := c.QueryStats(ctx, &statsService.QueryStatsRequest{
-		Pattern: "user>>>",
-		Reset_:  false,
+	mux := http.NewServeMux()
+	// A handler per request lets the Xray API calls of the scrape follow the
+	// request context, so a scrape Prometheus gave up on stops querying Xray
+	metricsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gatherer := prometheus.Gatherers{reg, instances.Gatherer(withTraceID(r))}
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+			// Negotiated, scrapers still get the text format unless they ask for OpenMetrics
+			EnableOpenMetrics: true,
+		}).ServeHTTP(w, r)
 	})
-	if err != nil {
-		return err
+	if cfg.MetricsEndpoint {
+		mux.Handle(cfg.MetricsPath, logRequests(protect(cfg, metricsHandler)))
 	}
-
-	xrayUserIPOnline.Reset()
-
-	users := make(map[string]struct{})
-	for _, stat := range resp.Stat {
-		user, ok := parseUser(stat.Name)
-		if ok {
-			users[user] = struct{}{}
+	if cfg.JSONEndpoint {
+		mux.Handle("/metrics.json", protect(cfg, metricsJSONHandler(instances)))
+	}
+	// With ADMIN_PORT the admin endpoints move to a loopback listener of
+	// their own, it only takes the Basic Auth credentials
+	adminMux, protectAdmin := mux, func(h http.Handler) http.Handler { return protect(cfg, h) }
+	if cfg.AdminPort != 0 {
+		adminMux = http.NewServeMux()
+		protectAdmin = func(h http.Handler) http.Handler {
+			return basicAuth(cfg.MetricsUsername, cfg.MetricsPassword, h)
 		}
 	}
+	if cfg.ManualScrape {
+		adminMux.Handle("POST /scrape", protectAdmin(scrapeHandler(instances)))
+	}
+	if cfg.DebugScrapes {
+		adminMux.Handle("/debug/scrapes", protectAdmin(http.HandlerFunc(debugScrapesHandler)))
+	}
+	if cfg.ConfigEndpoint {
+		adminMux.Handle("/config", protectAdmin(http.HandlerFunc(configHandler)))
+	}
+	if cfg.Pprof {
+		adminMux.Handle("/debug/pprof/", protectAdmin(http.HandlerFunc(pprof.Index)))
+		adminMux.Handle("/debug/pprof/cmdline", protectAdmin(http.HandlerFunc(pprof.Cmdline)))
+		adminMux.Handle("/debug/pprof/profile", protectAdmin(http.HandlerFunc(pprof.Profile)))
+		adminMux.Handle("/debug/pprof/symbol", protectAdmin(http.HandlerFunc(pprof.Symbol)))
+		adminMux.Handle("/debug/pprof/trace", protectAdmin(http.HandlerFunc(pprof.Trace)))
+	}
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler(instances))
+	mux.HandleFunc("/{$}", landingHandler)
+
+	addr := cfg.ListenAddr()
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  cfg.HTTPReadTimeout,
+		WriteTimeout: cfg.HTTPWriteTimeout,
+		IdleTimeout:  cfg.HTTPIdleTimeout,
+	}
 
-	for user := range users {
-		ctx2, cancel2 := context.WithTimeout(context.Background(), rpcTimeout)
-		ipResp, err := c.GetStatsOnlineIpList(ctx2, &statsService.GetStatsRequest{
-			Name: "user>>>" + user + ">>>online",
-		})
-		cancel2()
-		if err != nil {
-			log.Printf("GetStatsOnlineIpList error for user %s: %v", user, err)
-			continue
+	// Listening before serving lets systemd hear about readiness only once
+	// the port accepts connections
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("HTTP server failed", "error", err)
+	}
+	go func() {
+		var err error
+		if cfg.TLSCertFile != "" {
+			slog.Info("Exporter listening", "addr", addr, "path", cfg.MetricsPath, "tls", true)
+			err = srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			slog.Info("Exporter listening", "addr", addr, "path", cfg.MetricsPath, "tls", false)
+			err = srv.Serve(ln)
 		}
-
-		for ip := range ipResp.Ips {
-			xrayUserIPOnline.WithLabelValues(user, ip).Set(1) // 1 表示在线
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTP server failed", "error", err)
+		}
+	}()
+
+	var adminSrv *http.Server
+	if cfg.AdminPort != 0 {
+		adminSrv = &http.Server{
+			Addr:         cfg.AdminAddr(),
+			Handler:      adminMux,
+			ReadTimeout:  cfg.HTTPReadTimeout,
+			WriteTimeout: cfg.HTTPWriteTimeout,
+			IdleTimeout:  cfg.HTTPIdleTimeout,
+		}
+		if cfg.Pprof {
+			// CPU profiles and traces stream for as long as they were asked for
+			adminSrv.WriteTimeout = 0
+		}
+		adminLn, err := net.Listen("tcp", adminSrv.Addr)
+		if err != nil {
+			fatal("Admin HTTP server failed", "error", err)
 		}
+		go func() {
+			slog.Info("Admin endpoints listening", "addr", adminSrv.Addr)
+			if err := adminSrv.Serve(adminLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("Admin HTTP server failed", "error", err)
+			}
+		}()
 	}
+	go notifySystemd(ctx, instances)
 
-	return nil
-}
-
-// ================= PARSERS =================
+	<-ctx.Done()
+	slog.Info("Shutting down, draining HTTP server")
 
-func parseUser(statName string) (string, bool) {
-	parts := strings.Split(statName, ">>>")
-	if len(parts) < 2 {
-		return "", false
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), AppConfig().ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown error", "error", err)
+	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Admin HTTP server shutdown error", "error", err)
+		}
+	}
+	if shutdownOTLP != nil {
+		if err := shutdownOTLP(shutdownCtx); err != nil {
+			slog.Error("OTLP exporter shutdown error", "error", err)
+		}
 	}
-	return parts[1], true
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// fakeStats is a StatsServiceClient serving canned stats and online IPs.
+// The embedded interface is nil, methods the exporter doesn't call panic.
+type fakeStats struct {
+	statsService.StatsServiceClient
+
+	mu      sync.Mutex
+	stats   []*statsService.Stat
+	online  map[string]map[string]int64
+	err     error
+	queries int
+}
+
+func (f *fakeStats) QueryStats(_ context.Context, _ *statsService.QueryStatsRequest, _ ...grpc.CallOption) (*statsService.QueryStatsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &statsService.QueryStatsResponse{Stat: f.stats}, nil
+}
+
+func (f *fakeStats) GetStatsOnlineIpList(_ context.Context, in *statsService.GetStatsRequest, _ ...grpc.CallOption) (*statsService.GetStatsOnlineIpListResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user := strings.TrimSuffix(strings.TrimPrefix(in.Name, "user>>>"), ">>>online")
+	return &statsService.GetStatsOnlineIpListResponse{Name: in.Name, Ips: f.online[user]}, nil
+}
+
+func (f *fakeStats) GetSysStats(_ context.Context, _ *statsService.SysStatsRequest, _ ...grpc.CallOption) (*statsService.SysStatsResponse, error) {
+	return &statsService.SysStatsResponse{}, nil
+}
+
+// fakeConn is an xrayConn that is always ready.
+type fakeConn struct{}
+
+func (fakeConn) CheckState() connectivity.State { return connectivity.Ready }
+func (fakeConn) WaitReady(context.Context) bool { return true }
+func (fakeConn) Redial(*Config)                 {}
+func (fakeConn) Close() error                   { return nil }
+
+func stat(name string, value int64) *statsService.Stat {
+	return &statsService.Stat{Name: name, Value: value}
+}
+
+// setTestConfig makes the configuration read from env active for the test.
+func setTestConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	cfg := loadConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	old := AppConfig()
+	appConfig.Store(cfg)
+	t.Cleanup(func() { appConfig.Store(old) })
+	return cfg
+}
+
+// newTestInstance returns an instance served by stats, its series are
+// dropped when the test ends.
+func newTestInstance(t *testing.T, name string, stats *fakeStats) *xrayInstance {
+	t.Helper()
+	t.Cleanup(func() { deleteInstanceSeries(name) })
+	return &xrayInstance{
+		name:   name,
+		client: fakeConn{},
+		stats:  stats,
+		cache:  newStatsCache(stats, 0, false),
+	}
+}
+
+func TestTrafficCollectorCollect(t *testing.T) {
+	setTestConfig(t, nil)
+	stats := &fakeStats{stats: []*statsService.Stat{
+		stat("inbound>>>vless-in>>>traffic>>>uplink", 100),
+		stat("inbound>>>vless-in>>>traffic>>>downlink", 200),
+		stat("outbound>>>direct>>>traffic>>>downlink", 0),
+		stat("user>>>alice>>>traffic>>>uplink", 30),
+		stat("user>>>alice>>>online", 1),
+	}}
+	c := NewXrayTrafficCollector(context.Background(), newStatsCache(stats, 0, false), &trafficTotals{})
+
+	expected := `
+# HELP xray_traffic_bytes_total Xray traffic statistics
+# TYPE xray_traffic_bytes_total counter
+xray_traffic_bytes_total{direction="downlink",name="vless-in",type="inbound"} 200
+xray_traffic_bytes_total{direction="uplink",name="alice",type="user"} 30
+xray_traffic_bytes_total{direction="uplink",name="vless-in",type="inbound"} 100
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "xray_traffic_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrafficCollectorQueryError(t *testing.T) {
+	setTestConfig(t, nil)
+	stats := &fakeStats{err: errors.New("unavailable")}
+	c := NewXrayTrafficCollector(context.Background(), newStatsCache(stats, 0, false), &trafficTotals{})
+	if n := testutil.CollectAndCount(c); n != 0 {
+		t.Errorf("collected %d metrics after a failed QueryStats, want 0", n)
+	}
+}
+
+func TestScrapeOnlineUsersAndHealth(t *testing.T) {
+	setTestConfig(t, map[string]string{"USER_EXCLUDE_REGEX": "^test-"})
+	stats := &fakeStats{
+		stats: []*statsService.Stat{
+			stat("user>>>alice>>>traffic>>>uplink", 10),
+			stat("user>>>bob>>>traffic>>>downlink", 20),
+			stat("user>>>test-1>>>traffic>>>uplink", 5),
+			stat("inbound>>>vless-in>>>traffic>>>uplink", 35),
+		},
+		online: map[string]map[string]int64{
+			"alice": {"203.0.113.1": 1, "203.0.113.2": 1},
+		},
+	}
+	inst := newTestInstance(t, "test-scrape", stats)
+
+	users, err := scrapeOnlineUsersAndHealth(context.Background(), inst)
+	if err != nil {
+		t.Fatalf("scrapeOnlineUsersAndHealth: %v", err)
+	}
+	if users != 2 {
+		t.Errorf("users = %d, want 2", users)
+	}
+
+	expected := `
+# HELP xray_user_ip_online User online status per IP (1=online)
+# TYPE xray_user_ip_online gauge
+xray_user_ip_online{instance="test-scrape",ip="203.0.113.1",name="alice"} 1
+xray_user_ip_online{instance="test-scrape",ip="203.0.113.2",name="alice"} 1
+`
+	if err := testutil.CollectAndCompare(xrayUserIPOnline, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(xrayOnlineUsers.WithLabelValues("test-scrape")); got != 1 {
+		t.Errorf("xray_online_users = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(xrayUsersFiltered.WithLabelValues("test-scrape", "exclude")); got != 1 {
+		t.Errorf("xray_users_filtered_total{reason=exclude} = %v, want 1", got)
+	}
+}
+
+func TestScrapeOnceUp(t *testing.T) {
+	setTestConfig(t, nil)
+	stats := &fakeStats{stats: []*statsService.Stat{stat("inbound>>>vless-in>>>traffic>>>uplink", 1)}}
+	inst := newTestInstance(t, "test-up", stats)
+
+	if err := scrapeOnce(context.Background(), inst); err != nil {
+		t.Fatalf("scrapeOnce: %v", err)
+	}
+	if got := testutil.ToFloat64(xrayUp.WithLabelValues("test-up")); got != 1 {
+		t.Errorf("xray_up = %v after a successful scrape, want 1", got)
+	}
+
+	stats.err = errors.New("unavailable")
+	if err := scrapeOnce(context.Background(), inst); err == nil {
+		t.Fatal("scrapeOnce succeeded with a failing QueryStats")
+	}
+	if got := testutil.ToFloat64(xrayUp.WithLabelValues("test-up")); got != 0 {
+		t.Errorf("xray_up = %v after a failed scrape, want 0", got)
+	}
+}
+
+func TestScrapeOnceUpFromConnection(t *testing.T) {
+	setTestConfig(t, map[string]string{"ENABLE_ONLINE_USERS": "false", "XRAY_UP_FROM_CONNECTION": "true"})
+	stats := &fakeStats{stats: []*statsService.Stat{
+		stat("inbound>>>vless-in>>>traffic>>>uplink", 1),
+		stat("user>>>alice>>>traffic>>>uplink", 2),
+	}}
+	inst := newTestInstance(t, "test-up-conn", stats)
+	collector := NewXrayTrafficCollector(context.Background(), inst.cache, &inst.totals)
+
+	testutil.CollectAndCount(collector)
+	if err := scrapeOnce(context.Background(), inst); err != nil {
+		t.Fatalf("scrapeOnce: %v", err)
+	}
+	if stats.queries != 1 {
+		t.Errorf("QueryStats ran %d times, want only the collector's", stats.queries)
+	}
+	if got := testutil.ToFloat64(xrayStatsReturned.WithLabelValues("test-up-conn")); got != 2 {
+		t.Errorf("xray_stats_returned = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(xrayStatsUsers.WithLabelValues("test-up-conn")); got != 1 {
+		t.Errorf("xray_stats_users = %v, want 1", got)
+	}
+
+	stats.err = errors.New("unavailable")
+	testutil.CollectAndCount(collector)
+	if err := scrapeOnce(context.Background(), inst); err == nil {
+		t.Fatal("scrapeOnce succeeded after the collector's QueryStats failed")
+	}
+	if got := testutil.ToFloat64(xrayUp.WithLabelValues("test-up-conn")); got != 0 {
+		t.Errorf("xray_up = %v, want 0", got)
+	}
+}
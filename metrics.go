@@ -0,0 +1,358 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ================= METRICS =================
+
+// metricNamespace prefixes every metric name. It is read once at startup
+// since the metrics below are created before main runs.
+var metricNamespace = AppConfig().MetricNamespace
+
+// serverLabels holds the server label set by XRAY_INSTANCE_LABEL, it is
+// added to every metric and, like metricNamespace, read once at startup.
+var serverLabels = func() prometheus.Labels {
+	if server := AppConfig().InstanceLabel; server != "" {
+		return prometheus.Labels{"server": server}
+	}
+	return nil
+}()
+
+// metricName prefixes name with METRIC_NAMESPACE.
+func metricName(name string) string {
+	return prometheus.BuildFQName(metricNamespace, "", name)
+}
+
+var (
+	xrayTrafficRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("traffic_bytes_per_second"),
+			Help: "Xray traffic rate between the last two stats snapshots",
+		},
+		[]string{"instance", "type", "name", "direction"},
+	)
+
+	xrayObservedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricName("exporter_observed_bytes_total"),
+			Help: "Traffic seen by the exporter since it started, summed over names and kept counting across Xray counter resets",
+		},
+		[]string{"instance", "type", "direction"},
+	)
+
+	xrayUserIPOnline = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("user_ip_online"),
+			Help: "User online status per IP (1=online)",
+		},
+		userIPOnlineLabels(),
+	)
+
+	xrayUserOnlineIPCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("user_online_ip_count"),
+			Help: "Number of online IPs per user",
+		},
+		[]string{"instance", "name"},
+	)
+
+	xrayUserOnlineIPDistribution = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    metricName("user_online_ip_distribution"),
+			Help:    "Distribution of the number of online IPs per user, observed every scrape",
+			Buckets: []float64{1, 2, 3, 5, 10, 25, 50},
+		},
+		[]string{"instance"},
+	)
+
+	xrayUserOnlineIPAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("user_online_ip_age_seconds"),
+			Help: "Seconds since the online IP list of the user was last refreshed",
+		},
+		[]string{"instance", "name"},
+	)
+
+	xrayUserOnlineIPErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricName("user_online_ip_errors_total"),
+			Help: "Total number of failed online IP lookups of the user",
+		},
+		[]string{"instance", "name"},
+	)
+
+	xrayOnlineUsers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("online_users_total"),
+			Help: "Number of users with at least one online IP",
+		},
+		[]string{"instance"},
+	)
+
+	xrayOnlineIPs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("online_ips_total"),
+			Help: "Number of distinct online IPs across all users",
+		},
+		[]string{"instance"},
+	)
+
+	xrayOnlineIPsAvg = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("online_ips_avg"),
+			Help: "Average number of online IPs per online user, 0 without online users",
+		},
+		[]string{"instance"},
+	)
+
+	xrayOnlineIPsMax = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("online_ips_max"),
+			Help: "Largest number of online IPs of a single user",
+		},
+		[]string{"instance"},
+	)
+
+	xrayOnlineIPWorkers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("online_ip_workers_active"),
+			Help: "Online IP lookups in flight, at most ONLINE_IP_CONCURRENCY during a scrape and 0 between scrapes",
+		},
+		[]string{"instance"},
+	)
+
+	xrayOnlineIPsMaxAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("online_ips_max_age_seconds"),
+			Help: "Age of the oldest online IP lookup result in use, grows with ONLINE_IP_SPREAD",
+		},
+		[]string{"instance"},
+	)
+
+	xrayStatsReturned = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("stats_returned"),
+			Help: "Number of stat entries in the last QueryStats response",
+		},
+		[]string{"instance"},
+	)
+
+	xrayStatsProcessed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricName("stats_processed_total"),
+			Help: "Total number of QueryStats entries processed by the scrapes, by category (traffic, user, zero, filtered, other)",
+		},
+		[]string{"instance", "category"},
+	)
+
+	xrayStatsUsers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("stats_users"),
+			Help: "Number of users in the last QueryStats response passing the user filters",
+		},
+		[]string{"instance"},
+	)
+
+	xrayUsersFiltered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricName("users_filtered_total"),
+			Help: "Total number of users dropped by USER_INCLUDE_REGEX/USER_EXCLUDE_REGEX, counted once per scrape, by reason (exclude, not_included)",
+		},
+		[]string{"instance", "reason"},
+	)
+
+	xrayScrapeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    metricName("scrape_duration_seconds"),
+			Help:    "Duration of online users and health scrapes",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"instance"},
+	)
+
+	xrayScrapeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricName("scrape_errors_total"),
+			Help: "Total number of failed online users and health scrapes",
+		},
+		[]string{"instance"},
+	)
+
+	xrayScrapeLastError = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("scrape_last_error"),
+			Help: "Category of the error that failed the last scrape (timeout, unavailable, parse or other), absent after a successful scrape",
+		},
+		[]string{"instance", "error"},
+	)
+
+	xrayScrapePartial = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("scrape_partial"),
+			Help: "Whether the last scrape succeeded with some per-user online IP lookups failing (1=partial, 0=complete or failed)",
+		},
+		[]string{"instance"},
+	)
+
+	xrayLastScrapeSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("last_scrape_success_timestamp_seconds"),
+			Help: "Unix timestamp of the last successful scrape",
+		},
+		[]string{"instance"},
+	)
+
+	xrayScrapeInterval = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("scrape_interval_seconds"),
+			Help: "Pause before the next scrape, SCRAPE_INTERVAL or the failure backoff",
+		},
+		[]string{"instance"},
+	)
+
+	xrayAPIRPCDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    metricName("api_rpc_duration_seconds"),
+			Help:    "Duration of Xray stats API calls",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"instance", "method"},
+	)
+
+	xrayAPIConnectionState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("api_connection_state"),
+			Help: "State of the gRPC connection to Xray (1 for the current state)",
+		},
+		[]string{"instance", "state"},
+	)
+
+	xrayExporterBuildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("exporter_build_info"),
+			Help: "Build information of the exporter (constant 1)",
+		},
+		[]string{"version", "goversion", "commit"},
+	)
+
+	xrayExporterStartTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: metricName("exporter_start_time_seconds"),
+			Help: "Start time of the exporter since unix epoch in seconds",
+		},
+	)
+
+	xrayConfigReloads = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: metricName("exporter_config_reloads_total"),
+			Help: "Total number of configuration reload attempts",
+		},
+	)
+
+	xrayConfigLastReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: metricName("exporter_config_last_reload_success"),
+			Help: "Whether the last configuration reload succeeded (1=success, 0=failure)",
+		},
+	)
+
+	xrayConfigLastReloadSuccessTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: metricName("exporter_config_last_reload_success_timestamp_seconds"),
+			Help: "Unix timestamp of the last successful configuration reload, or of the start",
+		},
+	)
+
+	xrayUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricName("up"),
+			Help: "Whether Xray is reachable (1=up, 0=down)",
+		},
+		[]string{"instance"},
+	)
+)
+
+// userIPOnlineCountry and userIPOnlineHostname tell whether
+// xray_user_ip_online has its country and hostname labels. Like the label set
+// they are read once at startup, so a reload can't change the number of label
+// values.
+var (
+	userIPOnlineCountry  = AppConfig().GeoIPDB != ""
+	userIPOnlineHostname = AppConfig().ReverseDNS
+)
+
+// userIPOnlineLabels returns the labels of xray_user_ip_online, the optional
+// enrichment labels only exist when their feature is configured.
+func userIPOnlineLabels() []string {
+	labels := []string{"instance", "name", "ip"}
+	if userIPOnlineCountry {
+		labels = append(labels, "country")
+	}
+	if userIPOnlineHostname {
+		labels = append(labels, "hostname")
+	}
+	return labels
+}
+
+// userIPOnlineValues returns the label values matching userIPOnlineLabels.
+// With IP_MASK the ip label is the masked prefix, its country that of the
+// prefix address and the hostname is left empty since it varies inside a
+// prefix.
+func userIPOnlineValues(instance, user, ip string) []string {
+	label := AppConfig().MaskIP(ip)
+	lookup := ip
+	if label != ip {
+		lookup, _, _ = strings.Cut(label, "/")
+	}
+	values := []string{instance, AppConfig().UserAlias(user), label}
+	if userIPOnlineCountry {
+		country := ""
+		if ip != truncatedIPLabel {
+			country = ipCountry(lookup)
+		}
+		values = append(values, country)
+	}
+	if userIPOnlineHostname {
+		hostname := ""
+		if ip != truncatedIPLabel && label == ip {
+			hostname = ipHostname(ip)
+		}
+		values = append(values, hostname)
+	}
+	return values
+}
+
+// deleteInstanceSeries drops every series of a removed instance from the
+// instance-labelled vectors above.
+func deleteInstanceSeries(instance string) {
+	labels := prometheus.Labels{"instance": instance}
+	xrayTrafficRate.DeletePartialMatch(labels)
+	xrayObservedBytes.DeletePartialMatch(labels)
+	xrayUserIPOnline.DeletePartialMatch(labels)
+	xrayUserOnlineIPCount.DeletePartialMatch(labels)
+	xrayUserOnlineIPDistribution.DeletePartialMatch(labels)
+	xrayUserOnlineIPAge.DeletePartialMatch(labels)
+	xrayUserOnlineIPErrors.DeletePartialMatch(labels)
+	xrayOnlineUsers.DeletePartialMatch(labels)
+	xrayOnlineIPs.DeletePartialMatch(labels)
+	xrayOnlineIPsMaxAge.DeletePartialMatch(labels)
+	xrayOnlineIPsAvg.DeletePartialMatch(labels)
+	xrayOnlineIPsMax.DeletePartialMatch(labels)
+	xrayOnlineIPWorkers.DeletePartialMatch(labels)
+	xrayStatsReturned.DeletePartialMatch(labels)
+	xrayStatsUsers.DeletePartialMatch(labels)
+	xrayUsersFiltered.DeletePartialMatch(labels)
+	xrayStatsProcessed.DeletePartialMatch(labels)
+	xrayScrapeDuration.DeletePartialMatch(labels)
+	xrayScrapeErrors.DeletePartialMatch(labels)
+	xrayScrapeLastError.DeletePartialMatch(labels)
+	xrayScrapePartial.DeletePartialMatch(labels)
+	xrayLastScrapeSuccess.DeletePartialMatch(labels)
+	xrayScrapeInterval.DeletePartialMatch(labels)
+	xrayAPIRPCDuration.DeletePartialMatch(labels)
+	xrayAPIConnectionState.DeletePartialMatch(labels)
+	xrayUp.DeletePartialMatch(labels)
+}
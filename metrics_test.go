@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUserIPOnlineValuesAfterReload(t *testing.T) {
+	// The label set was built from the startup configuration, turning the
+	// enrichment on later must not change the number of values
+	setTestConfig(t, map[string]string{"ENABLE_REVERSE_DNS": "true", "GEOIP_DB": "/nonexistent.mmdb"})
+	labels, values := userIPOnlineLabels(), userIPOnlineValues("test", "alice", truncatedIPLabel)
+	if len(values) != len(labels) {
+		t.Fatalf("got %d label values %v for the labels %v", len(values), values, labels)
+	}
+	xrayUserIPOnline.WithLabelValues(values...).Set(1)
+	t.Cleanup(func() { deleteInstanceSeries("test") })
+}
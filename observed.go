@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+// ================= OBSERVED TRAFFIC =================
+
+// observedTraffic accumulates the growth of the traffic counters between
+// consecutive stats snapshots into xray_exporter_observed_bytes_total, which
+// keeps counting across Xray restarts since only the deltas are added.
+type observedTraffic struct {
+	mu   sync.Mutex
+	prev map[string]int64
+}
+
+// update adds the traffic of instance since the previous snapshot. The first
+// snapshot is only the baseline. A counter that went down, e.g. after Xray
+// restarted, and one that is new since the previous snapshot add their whole
+// value, it was all transferred since then. The previous values are kept by
+// stat name for every traffic stat, filtered ones included, so a changed
+// alias or tag name or a user included again only adds its growth.
+func (o *observedTraffic) update(instance string, stats []*statsService.Stat) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	current := make(map[string]int64)
+	for _, stat := range stats {
+		if _, _, _, ok := parseTraffic(stat.Name); ok {
+			current[stat.Name] = stat.Value
+		}
+	}
+
+	if o.prev != nil {
+		eachTrafficStatRaw(stats, func(stat *statsService.Stat, typ, _, direction string) {
+			delta := stat.Value
+			if last, ok := o.prev[stat.Name]; ok && stat.Value >= last {
+				delta = stat.Value - last
+			}
+			if delta > 0 {
+				xrayObservedBytes.WithLabelValues(instance, typ, AppConfig().DirectionLabel(direction)).Add(float64(delta))
+			}
+		})
+	}
+	o.prev = current
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+func TestObservedTraffic(t *testing.T) {
+	const instance = "observed"
+	t.Cleanup(func() { deleteInstanceSeries(instance) })
+	snapshot := func(value int64) []*statsService.Stat {
+		return []*statsService.Stat{stat("user>>>alice@x>>>traffic>>>uplink", value)}
+	}
+	observed := func() float64 {
+		return testutil.ToFloat64(xrayObservedBytes.WithLabelValues(instance, "user", "uplink"))
+	}
+	var o observedTraffic
+
+	setTestConfig(t, map[string]string{"USER_ALIAS_FILE": writeAliasFile(t, "alice@x=alice\n")})
+	o.update(instance, snapshot(100))
+	o.update(instance, snapshot(150))
+	if got := observed(); got != 50 {
+		t.Fatalf("observed = %v after growth, want 50", got)
+	}
+
+	// A new alias is the same counter
+	setTestConfig(t, map[string]string{"USER_ALIAS_FILE": writeAliasFile(t, "alice@x=a\n")})
+	o.update(instance, snapshot(160))
+	if got := observed(); got != 60 {
+		t.Fatalf("observed = %v after the alias changed, want 60", got)
+	}
+
+	// Growth while excluded isn't added, the user included again only adds
+	// what follows
+	setTestConfig(t, map[string]string{"USER_EXCLUDE_REGEX": "^alice"})
+	o.update(instance, snapshot(200))
+	setTestConfig(t, map[string]string{"USER_EXCLUDE_REGEX": ""})
+	o.update(instance, snapshot(210))
+	if got := observed(); got != 70 {
+		t.Fatalf("observed = %v after the user was included again, want 70", got)
+	}
+
+	// Xray restarted
+	o.update(instance, snapshot(5))
+	if got := observed(); got != 75 {
+		t.Errorf("observed = %v after a counter reset, want 75", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// ================= ONE-SHOT MODE =================
+
+// runOneshot scrapes every configured instance once, writes all metrics in
+// the text format to stdout and returns the process exit code, 1 when any
+// scrape or the gathering failed.
+func runOneshot(ctx context.Context, cfg *Config, reg *prometheus.Registry) int {
+	// The instances never start a scrape loop, so only their clients need closing
+	set := newInstanceSet()
+	defer func() {
+		for _, inst := range set.instances {
+			_ = inst.Close()
+		}
+	}()
+
+	code := 0
+	for _, addr := range cfg.XrayApis {
+		inst, err := newXrayInstance(cfg, addr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "connect to", addr, "failed:", err)
+			return 1
+		}
+		set.instances = append(set.instances, inst)
+		connectXray(ctx, inst)
+		if err := inst.scrape(ctx); err != nil {
+			code = 1
+		}
+	}
+
+	families, err := prometheus.Gatherers{reg, set.Gatherer(ctx)}.Gather()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gather metrics failed:", err)
+		code = 1
+	}
+	enc := expfmt.NewEncoder(os.Stdout, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			fmt.Fprintln(os.Stderr, "write metrics failed:", err)
+			return 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,138 @@
+//go:build otlp
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// ================= OTLP EXPORT =================
+
+// startOTLP pushes everything gathered from g to OTLP_ENDPOINT over
+// OTLP/gRPC once per scrape interval. The returned function flushes and
+// stops the exporter.
+func startOTLP(ctx context.Context, cfg *Config, g prometheus.Gatherer) (func(context.Context) error, error) {
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(cfg.OTLPEndpoint)}
+	if cfg.OTLPInsecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	exporter, err := otlpmetricgrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+
+	reader := metric.NewPeriodicReader(exporter,
+		metric.WithInterval(cfg.ScrapeInterval),
+		metric.WithProducer(&gathererProducer{gatherer: g, start: time.Now()}),
+	)
+	provider := metric.NewMeterProvider(
+		metric.WithReader(reader),
+		metric.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "xray-exporter"),
+			attribute.String("service.version", Version),
+		)),
+	)
+	return provider.Shutdown, nil
+}
+
+// gathererProducer bridges a Prometheus gatherer into the OpenTelemetry SDK.
+// Counters become monotonic cumulative sums, gauges stay gauges and
+// histograms are converted to explicit bucket histograms; summaries, which
+// the exporter doesn't use, are skipped.
+type gathererProducer struct {
+	gatherer prometheus.Gatherer
+	start    time.Time
+}
+
+func (p *gathererProducer) Produce(context.Context) ([]metricdata.ScopeMetrics, error) {
+	families, err := p.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return nil, err
+	}
+
+	now := time.Now()
+	metrics := make([]metricdata.Metrics, 0, len(families))
+	for _, mf := range families {
+		var data metricdata.Aggregation
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := metricdata.Sum[float64]{Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+			for _, m := range mf.GetMetric() {
+				sum.DataPoints = append(sum.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: labelSet(m), StartTime: p.start, Time: now, Value: m.GetCounter().GetValue(),
+				})
+			}
+			data = sum
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := metricdata.Gauge[float64]{}
+			for _, m := range mf.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, metricdata.DataPoint[float64]{
+					Attributes: labelSet(m), Time: now, Value: value,
+				})
+			}
+			data = gauge
+		case dto.MetricType_HISTOGRAM:
+			hist := metricdata.Histogram[float64]{Temporality: metricdata.CumulativeTemporality}
+			for _, m := range mf.GetMetric() {
+				hist.DataPoints = append(hist.DataPoints, histogramPoint(m, p.start, now))
+			}
+			data = hist
+		default:
+			continue
+		}
+		metrics = append(metrics, metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp(), Data: data})
+	}
+
+	return []metricdata.ScopeMetrics{{
+		Scope:   instrumentation.Scope{Name: "xray-exporter", Version: Version},
+		Metrics: metrics,
+	}}, nil
+}
+
+func labelSet(m *dto.Metric) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		kvs = append(kvs, attribute.String(l.GetName(), l.GetValue()))
+	}
+	return attribute.NewSet(kvs...)
+}
+
+// histogramPoint turns the cumulative Prometheus buckets into per-bucket
+// counts, the +Inf bucket is implied by OpenTelemetry.
+func histogramPoint(m *dto.Metric, start, now time.Time) metricdata.HistogramDataPoint[float64] {
+	h := m.GetHistogram()
+	point := metricdata.HistogramDataPoint[float64]{
+		Attributes: labelSet(m),
+		StartTime:  start,
+		Time:       now,
+		Count:      h.GetSampleCount(),
+		Sum:        h.GetSampleSum(),
+	}
+	var prev uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		point.Bounds = append(point.Bounds, b.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, b.GetCumulativeCount()-prev)
+		prev = b.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-prev)
+	return point
+}
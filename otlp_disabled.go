@@ -0,0 +1,16 @@
+//go:build !otlp
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// startOTLP is the stand-in for builds without the otlp tag, which leave the
+// OpenTelemetry SDK out of the binary.
+func startOTLP(context.Context, *Config, prometheus.Gatherer) (func(context.Context) error, error) {
+	return nil, errors.New("OTLP_ENDPOINT is set but the exporter was built without OTLP support, rebuild with -tags otlp")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+)
+
+// ================= PARSERS =================
+
+// The parsers run for every stat on every scrape, so they only cut and slice
+// the input instead of splitting it and never allocate.
+
+const (
+	statSep       = ">>>"
+	trafficAnchor = ">>>traffic>>>"
+)
+
+// parseTraffic splits "type>>>name>>>traffic>>>direction". The type is the
+// leading token and the direction follows the last traffic anchor, so
+// everything in between is the name even if it contains the separator.
+func parseTraffic(statName string) (typ, name, direction string, ok bool) {
+	typ, rest, found := strings.Cut(statName, statSep)
+	if !found || typ == "" {
+		return "", "", "", false
+	}
+	i := strings.LastIndex(rest, trafficAnchor)
+	if i <= 0 {
+		return "", "", "", false
+	}
+	name, direction = rest[:i], rest[i+len(trafficAnchor):]
+	if direction == "" || strings.Contains(direction, statSep) {
+		return "", "", "", false
+	}
+	return typ, name, direction, true
+}
+
+// parseUser extracts the user from "user>>>name>>>traffic>>>direction" or
+// any other "user>>>name>>>metric" stat, anchoring on the known suffix.
+func parseUser(statName string) (string, bool) {
+	if _, name, _, ok := parseTraffic(statName); ok {
+		return name, true
+	}
+	_, rest, found := strings.Cut(statName, statSep)
+	if !found || rest == "" {
+		return "", false
+	}
+	if i := strings.LastIndex(rest, statSep); i > 0 {
+		return rest[:i], true
+	}
+	return rest, true
+}
+
+// connectionSuffixes are the counter names Xray builds and forks have used
+// for connection counts, stock Xray does not report any yet.
+var connectionSuffixes = []string{">>>conn", ">>>connections"}
+
+// parseConnections splits "inbound>>>tag>>>conn" or "outbound>>>tag>>>conn",
+// any other stat, including ones using an unknown suffix, is not a
+// connection counter.
+func parseConnections(statName string) (typ, tag string, ok bool) {
+	typ, rest, found := strings.Cut(statName, statSep)
+	if !found || (typ != "inbound" && typ != "outbound") {
+		return "", "", false
+	}
+	for _, suffix := range connectionSuffixes {
+		if tag, found := strings.CutSuffix(rest, suffix); found && tag != "" {
+			return typ, tag, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+)
+
+var parseTrafficTests = []struct {
+	stat                 string
+	typ, name, direction string
+	ok                   bool
+}{
+	{"inbound>>>api>>>traffic>>>uplink", "inbound", "api", "uplink", true},
+	{"outbound>>>direct>>>traffic>>>downlink", "outbound", "direct", "downlink", true},
+	{"user>>>alice@example.com>>>traffic>>>uplink", "user", "alice@example.com", "uplink", true},
+	// Embedded separators stay in the name
+	{"user>>>a>>>b>>>traffic>>>downlink", "user", "a>>>b", "downlink", true},
+	{"user>>>x>>>traffic>>>traffic>>>uplink", "user", "x>>>traffic", "uplink", true},
+	// Too few parts
+	{"", "", "", "", false},
+	{"inbound", "", "", "", false},
+	{"inbound>>>api", "", "", "", false},
+	{"inbound>>>api>>>traffic", "", "", "", false},
+	{"inbound>>>api>>>traffic>>>", "", "", "", false},
+	{">>>api>>>traffic>>>uplink", "", "", "", false},
+	{"inbound>>>>>>traffic>>>uplink", "", "", "", false},
+	// Too many parts
+	{"inbound>>>api>>>traffic>>>uplink>>>extra", "", "", "", false},
+	// Not traffic
+	{"user>>>alice>>>online", "", "", "", false},
+	{"inbound>>>api>>>conn", "", "", "", false},
+}
+
+func TestParseTraffic(t *testing.T) {
+	for _, tt := range parseTrafficTests {
+		typ, name, direction, ok := parseTraffic(tt.stat)
+		if typ != tt.typ || name != tt.name || direction != tt.direction || ok != tt.ok {
+			t.Errorf("parseTraffic(%q) = %q, %q, %q, %v, want %q, %q, %q, %v",
+				tt.stat, typ, name, direction, ok, tt.typ, tt.name, tt.direction, tt.ok)
+		}
+	}
+}
+
+func TestParseUser(t *testing.T) {
+	tests := []struct {
+		stat string
+		user string
+		ok   bool
+	}{
+		{"user>>>alice>>>traffic>>>uplink", "alice", true},
+		{"user>>>alice>>>online", "alice", true},
+		{"user>>>alice", "alice", true},
+		// Embedded separators stay in the user
+		{"user>>>a>>>b>>>traffic>>>uplink", "a>>>b", true},
+		{"user>>>a>>>b>>>online", "a>>>b", true},
+		// Too few parts
+		{"user", "", false},
+		{"user>>>", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		user, ok := parseUser(tt.stat)
+		if user != tt.user || ok != tt.ok {
+			t.Errorf("parseUser(%q) = %q, %v, want %q, %v", tt.stat, user, ok, tt.user, tt.ok)
+		}
+	}
+}
+
+// TestParseTrafficAllocs backs the promise of the parsers not to allocate.
+func TestParseTrafficAllocs(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, tt := range parseTrafficTests {
+			parseTraffic(tt.stat)
+			parseUser(tt.stat)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("parseTraffic and parseUser allocate %v times per run, want 0", allocs)
+	}
+}
+
+func BenchmarkParseTraffic(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, tt := range parseTrafficTests {
+			parseTraffic(tt.stat)
+		}
+	}
+}
+
+func TestParseConnections(t *testing.T) {
+	tests := []struct {
+		stat     string
+		typ, tag string
+		ok       bool
+	}{
+		{"inbound>>>vless-in>>>conn", "inbound", "vless-in", true},
+		{"outbound>>>direct>>>connections", "outbound", "direct", true},
+		{"inbound>>>a>>>b>>>conn", "inbound", "a>>>b", true},
+		// Unknown suffixes
+		{"inbound>>>vless-in>>>connection", "", "", false},
+		{"inbound>>>vless-in>>>conns", "", "", false},
+		{"inbound>>>vless-in>>>traffic>>>uplink", "", "", false},
+		// Users have no connection counters
+		{"user>>>alice>>>conn", "", "", false},
+		{"user>>>alice>>>connections", "", "", false},
+		// Missing tag
+		{"inbound>>>conn", "", "", false},
+		{"inbound>>>>>>conn", "", "", false},
+	}
+	for _, tt := range tests {
+		typ, tag, ok := parseConnections(tt.stat)
+		if typ != tt.typ || tag != tt.tag || ok != tt.ok {
+			t.Errorf("parseConnections(%q) = %q, %q, %v, want %q, %q, %v", tt.stat, typ, tag, ok, tt.typ, tt.tag, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// ================= PUSHGATEWAY =================
+
+// pushLoop pushes everything gathered from g to PUSHGATEWAY_URL once per
+// scrape interval until ctx is done. It runs next to the /metrics endpoint,
+// which stays available for pull-based scraping.
+func pushLoop(ctx context.Context, cfg *Config, g prometheus.Gatherer) {
+	pusher := push.New(cfg.PushgatewayURL, cfg.PushgatewayJob).Gatherer(g)
+	for _, kv := range cfg.PushgatewayGrouping {
+		name, value, _ := strings.Cut(kv, "=")
+		pusher = pusher.Grouping(name, value)
+	}
+	// Logged with the password of a user:password@ masked
+	target := cfg.PushgatewayURL
+	if u, err := url.Parse(target); err == nil {
+		target = u.Redacted()
+	}
+	slog.Info("Pushing metrics to Pushgateway", "url", target, "job", cfg.PushgatewayJob)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(AppConfig().ScrapeInterval):
+			if err := pusher.PushContext(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Push to Pushgateway failed", "url", target, "error", err)
+			}
+		}
+	}
+}
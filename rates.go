@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ================= TRAFFIC RATES =================
+
+// trafficRates derives xray_traffic_bytes_per_second from consecutive stats
+// snapshots, for backends that can't compute rate() themselves.
+type trafficRates struct {
+	mu     sync.Mutex
+	prev   map[[3]string]int64
+	prevAt time.Time
+}
+
+// update sets the rates of instance from stats read at fetchedAt. A snapshot
+// already seen is ignored, and a counter that went down, e.g. after Xray
+// restarted, reports 0 for that interval.
+func (r *trafficRates) update(instance string, stats []*statsService.Stat, fetchedAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !fetchedAt.After(r.prevAt) {
+		return
+	}
+	elapsed := fetchedAt.Sub(r.prevAt).Seconds()
+
+	current := make(map[[3]string]int64)
+	eachTrafficStat(stats, func(typ, name, direction string, value int64) {
+		current[[3]string{typ, name, direction}] = value
+	})
+
+	xrayTrafficRate.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	if r.prev != nil {
+		for key, value := range current {
+			last, ok := r.prev[key]
+			if !ok {
+				continue
+			}
+			rate := 0.0
+			if value >= last {
+				rate = float64(value-last) / elapsed
+			}
+			xrayTrafficRate.WithLabelValues(instance, key[0], key[1], AppConfig().DirectionLabel(key[2])).Set(rate)
+		}
+	}
+
+	r.prev = current
+	r.prevAt = fetchedAt
+}
+
+// reset forgets the previous snapshot, used while rate metrics are disabled
+// so re-enabling them doesn't report a rate over the whole gap.
+func (r *trafficRates) reset(instance string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prev = nil
+	r.prevAt = time.Time{}
+	xrayTrafficRate.DeletePartialMatch(prometheus.Labels{"instance": instance})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ================= REVERSE DNS =================
+
+// rdnsLookupTimeout bounds a single PTR lookup, rdnsMaxLookups the number
+// running at the same time.
+const (
+	rdnsLookupTimeout = 5 * time.Second
+	rdnsMaxLookups    = 16
+)
+
+type rdnsEntry struct {
+	hostname string
+	expires  time.Time
+}
+
+// rdnsCache resolves IPs to PTR hostnames in the background. Lookups never
+// block the scrape: an IP seen for the first time gets an empty hostname
+// until its lookup finishes, expired entries keep their value until they
+// are refreshed.
+type rdnsCache struct {
+	mu        sync.Mutex
+	entries   map[string]rdnsEntry
+	pending   map[string]bool
+	lastPrune time.Time
+	sem       chan struct{}
+}
+
+var hostnames = &rdnsCache{
+	entries: make(map[string]rdnsEntry),
+	pending: make(map[string]bool),
+	sem:     make(chan struct{}, rdnsMaxLookups),
+}
+
+// ipHostname returns the cached hostname of ip, "" when it's unknown or
+// has no PTR record, and schedules a lookup when the entry is missing or
+// expired.
+func ipHostname(ip string) string {
+	return hostnames.get(ip, AppConfig().ReverseDNSTTL)
+}
+
+func (c *rdnsCache) get(ip string, ttl time.Duration) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[ip]
+	if (!ok || time.Now().After(entry.expires)) && !c.pending[ip] {
+		c.pending[ip] = true
+		go c.lookup(ip, ttl)
+	}
+	return entry.hostname
+}
+
+func (c *rdnsCache) lookup(ip string, ttl time.Duration) {
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsLookupTimeout)
+	defer cancel()
+	var hostname string
+	if names, err := net.DefaultResolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+		hostname = strings.TrimSuffix(names[0], ".")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.entries[ip] = rdnsEntry{hostname: hostname, expires: now.Add(ttl)}
+	delete(c.pending, ip)
+
+	// Drop IPs that have not been asked for in a whole TTL
+	if now.Sub(c.lastPrune) > ttl {
+		for key, e := range c.entries {
+			if now.Sub(e.expires) > ttl {
+				delete(c.entries, key)
+			}
+		}
+		c.lastPrune = now
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ================= CONFIG RELOAD =================
+
+// reloadOnSIGHUP re-reads the configuration on every SIGHUP until ctx is done.
+func reloadOnSIGHUP(ctx context.Context, instances *instanceSet) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			xrayConfigReloads.Inc()
+			if err := reloadConfig(ctx, instances); err != nil {
+				xrayConfigLastReloadSuccess.Set(0)
+				slog.Error("Config reload failed, keeping the previous configuration", "error", err)
+				continue
+			}
+			xrayConfigLastReloadSuccess.Set(1)
+			xrayConfigLastReloadSuccessTime.Set(float64(time.Now().Unix()))
+		}
+	}
+}
+
+// reloadConfig swaps in a freshly loaded configuration. Settings read on
+// every use (intervals, timeouts, log level, user filters, ...) apply
+// immediately; instances are added, removed or redialed to match the new
+// endpoints. A configuration changing settings bound at startup is rejected,
+// as is one whose new instances can't be dialed, the previous configuration
+// then stays active.
+func reloadConfig(ctx context.Context, instances *instanceSet) error {
+	old := AppConfig()
+	cfg := loadConfig()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if changed := restartOnlyChanges(old, cfg); len(changed) > 0 {
+		return fmt.Errorf("%s only apply after a restart", strings.Join(changed, ", "))
+	}
+
+	appConfig.Store(cfg)
+	setupLogger(cfg)
+
+	if err := instances.Sync(ctx, cfg); err != nil {
+		// Sync dials before touching the instances, they still match old
+		appConfig.Store(old)
+		setupLogger(old)
+		return err
+	}
+
+	slog.Info("Configuration reloaded")
+	return nil
+}
+
+// restartOnlyChanges lists the settings that differ between old and cfg but
+// are only read at startup.
+func restartOnlyChanges(old, cfg *Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("PORT", old.Port != cfg.Port)
+	check("BIND_ADDRESS", old.BindAddress != cfg.BindAddress)
+	check("METRICS_PATH", old.MetricsPath != cfg.MetricsPath)
+	check("METRICS_USERNAME", old.MetricsUsername != cfg.MetricsUsername)
+	check("METRICS_PASSWORD", old.MetricsPassword != cfg.MetricsPassword)
+	check("METRICS_ALLOW_CIDRS", !slices.Equal(old.MetricsAllowCIDRs, cfg.MetricsAllowCIDRs))
+	check("TRUST_PROXY", old.TrustProxy != cfg.TrustProxy)
+	check("HTTP_READ_TIMEOUT", old.HTTPReadTimeout != cfg.HTTPReadTimeout)
+	check("HTTP_WRITE_TIMEOUT", old.HTTPWriteTimeout != cfg.HTTPWriteTimeout)
+	check("HTTP_IDLE_TIMEOUT", old.HTTPIdleTimeout != cfg.HTTPIdleTimeout)
+	check("TLS_CERT_FILE", old.TLSCertFile != cfg.TLSCertFile)
+	check("TLS_KEY_FILE", old.TLSKeyFile != cfg.TLSKeyFile)
+	check("ENABLE_RUNTIME_METRICS", old.RuntimeMetrics != cfg.RuntimeMetrics)
+	check("GEOIP_DB", old.GeoIPDB != cfg.GeoIPDB)
+	check("ENABLE_REVERSE_DNS", old.ReverseDNS != cfg.ReverseDNS)
+	check("ENABLE_CONFIG_ENDPOINT", old.ConfigEndpoint != cfg.ConfigEndpoint)
+	check("ENABLE_JSON_ENDPOINT", old.JSONEndpoint != cfg.JSONEndpoint)
+	check("ADMIN_PORT", old.AdminPort != cfg.AdminPort)
+	check("ENABLE_MANUAL_SCRAPE", old.ManualScrape != cfg.ManualScrape)
+	check("ENABLE_PPROF", old.Pprof != cfg.Pprof)
+	check("ENABLE_DEBUG_SCRAPES", old.DebugScrapes != cfg.DebugScrapes)
+	check("PUSHGATEWAY_URL", old.PushgatewayURL != cfg.PushgatewayURL)
+	check("PUSHGATEWAY_JOB", old.PushgatewayJob != cfg.PushgatewayJob)
+	check("PUSHGATEWAY_GROUPING", !slices.Equal(old.PushgatewayGrouping, cfg.PushgatewayGrouping))
+	check("OTLP_ENDPOINT", old.OTLPEndpoint != cfg.OTLPEndpoint)
+	check("OTLP_INSECURE", old.OTLPInsecure != cfg.OTLPInsecure)
+	check("ENABLE_METRICS_ENDPOINT", old.MetricsEndpoint != cfg.MetricsEndpoint)
+	check("METRIC_NAMESPACE", old.MetricNamespace != cfg.MetricNamespace)
+	check("XRAY_INSTANCE_LABEL", old.InstanceLabel != cfg.InstanceLabel)
+	// The stats cache of a running instance keeps its settings
+	check("STATS_CACHE_TTL", old.StatsCacheTTL != cfg.StatsCacheTTL && slices.Equal(old.XrayApis, cfg.XrayApis))
+	check("RESET_TRAFFIC", old.ResetTraffic != cfg.ResetTraffic && slices.Equal(old.XrayApis, cfg.XrayApis))
+	check("RESET_SCHEDULE", old.ResetSchedule != cfg.ResetSchedule)
+	return changed
+}
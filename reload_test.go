@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReloadRejectsRestartOnlyChanges(t *testing.T) {
+	before := setTestConfig(t, nil)
+	t.Setenv("GEOIP_DB", "/nonexistent.mmdb")
+	t.Setenv("SCRAPE_INTERVAL", "1m")
+
+	if err := reloadConfig(context.Background(), newInstanceSet()); err == nil {
+		t.Fatal("reloadConfig() succeeded with a new GEOIP_DB")
+	}
+	// Nothing of the rejected configuration applies
+	if AppConfig() != before {
+		t.Error("the rejected configuration is active")
+	}
+}
+
+func TestReloadKeepsConfigOnDialError(t *testing.T) {
+	before := setTestConfig(t, nil)
+	t.Setenv("XRAY_APIS", "127.0.0.1:1")
+	t.Setenv("XRAY_API_TLS", "true")
+	t.Setenv("XRAY_API_CA_FILE", "/nonexistent.pem")
+
+	instances := newInstanceSet()
+	defer instances.Close()
+	if err := reloadConfig(context.Background(), instances); err == nil {
+		t.Fatal("reloadConfig() succeeded with an unreadable XRAY_API_CA_FILE")
+	}
+	if AppConfig() != before {
+		t.Error("the configuration that failed to dial is active")
+	}
+	if n := len(instances.List()); n != 0 {
+		t.Errorf("%d instances after the failed reload, want 0", n)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// ================= SCHEDULED RESET =================
+
+// resetOnSchedule zeroes the counters inside every Xray instance at the
+// times of RESET_SCHEDULE. The stats caches keep the values read at the
+// reset, so the exported counters stay monotonic.
+func resetOnSchedule(ctx context.Context, cfg *Config, instances *instanceSet) {
+	for {
+		next := cfg.resetSchedule.Next(time.Now())
+		slog.Debug("Next scheduled counter reset", "at", next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		for _, inst := range instances.List() {
+			if err := inst.cache.Reset(ctx); err != nil {
+				slog.Warn("Scheduled counter reset failed", "instance", inst.name, "error", err)
+				continue
+			}
+			slog.Info("Reset Xray counters", "instance", inst.name)
+		}
+	}
+}
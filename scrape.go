@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ================= SCRAPE LOOP & FUNCTIONS =================
+
+func scrapeLoop(ctx context.Context, inst *xrayInstance) {
+	slog.Info("Scrape loop started", "instance", inst.name)
+
+	failCount := 0
+
+	connectXray(ctx, inst)
+
+	// The delay is only for deployments that start Xray and the exporter at
+	// the same time
+	sleep := AppConfig().StartupDelay
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Scrape loop stopped", "instance", inst.name)
+			return
+		case <-time.After(sleep):
+			if err := inst.scrape(ctx); err != nil {
+				failCount++
+			} else {
+				failCount = 0
+			}
+
+			sleep = scrapeDelay(AppConfig(), failCount)
+			xrayScrapeInterval.WithLabelValues(inst.name).Set(sleep.Seconds())
+		}
+	}
+}
+
+// scrapeDelay returns the pause before the next scrape after failCount
+// consecutive failures: SCRAPE_INTERVAL below FAIL_THRESHOLD, then
+// FAIL_INTERVAL doubling with every further failure up to FAIL_BACKOFF_MAX.
+func scrapeDelay(cfg *Config, failCount int) time.Duration {
+	if failCount < cfg.FailThreshold {
+		return cfg.ScrapeInterval
+	}
+	limit := max(cfg.FailBackoffMax, cfg.FailInterval)
+	delay := cfg.FailInterval
+	for range failCount - cfg.FailThreshold {
+		if delay >= limit/2 {
+			return limit
+		}
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+// connectXray waits up to DIAL_TIMEOUT for the connection of inst, keeping
+// the dial out of the first scrape's RPC_TIMEOUT. A failure is only logged
+// and left to the scrapes to report.
+func connectXray(ctx context.Context, inst *xrayInstance) {
+	dialCtx, cancel := context.WithTimeout(ctx, AppConfig().DialTimeout)
+	defer cancel()
+	start := time.Now()
+	if inst.client.WaitReady(dialCtx) {
+		slog.Info("Connected to Xray", "instance", inst.name, "duration", time.Since(start))
+	} else if ctx.Err() == nil {
+		slog.Warn("Xray not reachable within DIAL_TIMEOUT, scraping anyway", "instance", inst.name, "dial_timeout", AppConfig().DialTimeout)
+	}
+}
+
+// scrapeOnce runs one scrape cycle of inst and records its outcome in
+// xray_up and the scrape metrics.
+func scrapeOnce(ctx context.Context, inst *xrayInstance) error {
+	start := time.Now()
+	users, err := scrapeOnlineUsersAndHealth(ctx, inst)
+	duration := time.Since(start)
+	xrayScrapeDuration.WithLabelValues(inst.name).Observe(duration.Seconds())
+	defer func() {
+		recentScrapes.add(newScrapeRecord(inst.name, start, duration, users, err))
+	}()
+	state := inst.client.CheckState()
+	setConnectionState(inst.name, state)
+	category := scrapeErrorCategory(err)
+	if err == nil && (state == connectivity.TransientFailure || state == connectivity.Shutdown) {
+		err = fmt.Errorf("connection is %s", state)
+		category = "unavailable"
+	}
+	xrayScrapeLastError.DeletePartialMatch(prometheus.Labels{"instance": inst.name})
+	if err != nil {
+		xrayUp.WithLabelValues(inst.name).Set(0)
+		inst.up.Store(false)
+		xrayScrapeErrors.WithLabelValues(inst.name).Inc()
+		xrayScrapeLastError.WithLabelValues(inst.name, category).Set(1)
+		// A failed scrape is not a partial one
+		xrayScrapePartial.WithLabelValues(inst.name).Set(0)
+		slog.Error("scrapeOnlineUsersAndHealth error", "instance", inst.name, "error", err)
+		return err
+	}
+	xrayUp.WithLabelValues(inst.name).Set(1)
+	inst.up.Store(true)
+	xrayLastScrapeSuccess.WithLabelValues(inst.name).Set(float64(time.Now().Unix()))
+	return nil
+}
+
+// scrapeErrorCategory maps a scrape error to the error label of
+// xray_scrape_last_error, a fixed set so the label stays bounded.
+func scrapeErrorCategory(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	switch status.Code(err) {
+	case codes.DeadlineExceeded:
+		return "timeout"
+	case codes.Unavailable:
+		return "unavailable"
+	case codes.Internal:
+		// gRPC reports responses it can't decode as Internal
+		return "parse"
+	}
+	return "other"
+}
+
+// connectionStates are the values of the state label, in the order of
+// connectivity.State.
+var connectionStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+// setConnectionState sets xray_api_connection_state to 1 for current and to
+// 0 for every other state.
+func setConnectionState(instance string, current connectivity.State) {
+	for _, state := range connectionStates {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+		xrayAPIConnectionState.WithLabelValues(instance, state.String()).Set(value)
+	}
+}
+
+// truncatedIPLabel replaces the ip series of users above MAX_IPS_PER_USER.
+const truncatedIPLabel = "_truncated_"
+
+// warnedTruncatedUsers remembers the instance and user pairs warned about
+// exceeding MAX_IPS_PER_USER, later scrapes only log the truncation at debug
+// level.
+var warnedTruncatedUsers sync.Map
+
+// scrapeOnlineUsersAndHealth queries the stats and online IPs of inst and
+// returns the number of users seen. With XRAY_UP_FROM_CONNECTION it skips
+// the QueryStats of its own and works on the last snapshot of the traffic
+// collector instead, whose error is then the health check.
+func scrapeOnlineUsersAndHealth(ctx context.Context, inst *xrayInstance) (int, error) {
+	var (
+		stats     []*statsService.Stat
+		fetchedAt time.Time
+		err       error
+	)
+	if cfg := AppConfig(); cfg.UpFromConnection && !cfg.OnlineUsersEnabled {
+		stats, fetchedAt, err = inst.cache.Last()
+	} else {
+		stats, fetchedAt, err = inst.cache.Snapshot(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if fetchedAt.IsZero() {
+		// Prometheus hasn't scraped yet, the connection state decides
+		clearOnlineMetrics(inst)
+		return 0, nil
+	}
+	xrayStatsReturned.WithLabelValues(inst.name).Set(float64(len(stats)))
+	countProcessedStats(inst.name, stats)
+
+	inst.observed.update(inst.name, stats)
+	if AppConfig().RateMetrics {
+		inst.rates.update(inst.name, stats, fetchedAt)
+	} else {
+		inst.rates.reset(inst.name)
+	}
+
+	users := make(map[string]struct{})
+	filtered := make(map[string]string)
+	all := statUsers(stats)
+	for _, stat := range stats {
+		if !strings.HasPrefix(stat.Name, "user>>>") {
+			continue
+		}
+		user, ok := parseUser(stat.Name)
+		if !ok {
+			continue
+		}
+		if reason := AppConfig().UserFilterReason(user); reason != "" {
+			filtered[user] = reason
+			continue
+		}
+		// Its online series would merge with the other user's
+		if aliasTaken(all, user) {
+			continue
+		}
+		users[user] = struct{}{}
+	}
+	xrayStatsUsers.WithLabelValues(inst.name).Set(float64(len(users)))
+	countFilteredUsers(inst.name, filtered)
+
+	instLabel := prometheus.Labels{"instance": inst.name}
+	if !AppConfig().OnlineUsersEnabled || inst.onlineUnsupported.Load() {
+		// QueryStats above still serves as the health check
+		clearOnlineMetrics(inst)
+		return len(users), nil
+	}
+
+	onlineIPs := inst.refreshOnlineIPs(ctx, users)
+	inst.online.Store(&onlineIPs)
+
+	xrayUserIPOnline.DeletePartialMatch(instLabel)
+	xrayUserOnlineIPCount.DeletePartialMatch(instLabel)
+
+	onlineUsers, ipSum, ipMax := 0, 0, 0
+	distinctIPs := make(map[string]struct{})
+	for user, ips := range onlineIPs {
+		if maxIPs := AppConfig().MaxIPsPerUser; maxIPs > 0 && len(ips) > maxIPs {
+			level := slog.LevelWarn
+			if _, warned := warnedTruncatedUsers.LoadOrStore([2]string{inst.name, user}, struct{}{}); warned {
+				level = slog.LevelDebug
+			}
+			slog.Log(ctx, level, "User exceeds MAX_IPS_PER_USER, truncating ip series", "instance", inst.name, "user", user, "ips", len(ips), "max", maxIPs)
+			xrayUserIPOnline.WithLabelValues(userIPOnlineValues(inst.name, user, truncatedIPLabel)...).Set(1)
+		} else {
+			for ip := range ips {
+				xrayUserIPOnline.WithLabelValues(userIPOnlineValues(inst.name, user, ip)...).Set(1) // 1 表示在线
+			}
+		}
+		xrayUserOnlineIPCount.WithLabelValues(inst.name, AppConfig().UserAlias(user)).Set(float64(len(ips)))
+		xrayUserOnlineIPDistribution.WithLabelValues(inst.name).Observe(float64(len(ips)))
+		if len(ips) > 0 {
+			onlineUsers++
+			ipSum += len(ips)
+			ipMax = max(ipMax, len(ips))
+		}
+		for ip := range ips {
+			distinctIPs[ip] = struct{}{}
+		}
+	}
+	xrayOnlineUsers.WithLabelValues(inst.name).Set(float64(onlineUsers))
+	xrayOnlineIPs.WithLabelValues(inst.name).Set(float64(len(distinctIPs)))
+	ipAvg := 0.0
+	if onlineUsers > 0 {
+		ipAvg = float64(ipSum) / float64(onlineUsers)
+	}
+	xrayOnlineIPsAvg.WithLabelValues(inst.name).Set(ipAvg)
+	xrayOnlineIPsMax.WithLabelValues(inst.name).Set(float64(ipMax))
+
+	return len(users), nil
+}
+
+// clearOnlineMetrics drops the online IP series of inst while the lookups
+// are off.
+func clearOnlineMetrics(inst *xrayInstance) {
+	instLabel := prometheus.Labels{"instance": inst.name}
+	inst.online.Store(nil)
+	xrayUserIPOnline.DeletePartialMatch(instLabel)
+	xrayUserOnlineIPCount.DeletePartialMatch(instLabel)
+	xrayUserOnlineIPDistribution.DeletePartialMatch(instLabel)
+	xrayOnlineUsers.DeletePartialMatch(instLabel)
+	xrayOnlineIPs.DeletePartialMatch(instLabel)
+	xrayOnlineIPsMaxAge.DeletePartialMatch(instLabel)
+	xrayOnlineIPsAvg.DeletePartialMatch(instLabel)
+	xrayOnlineIPsMax.DeletePartialMatch(instLabel)
+	xrayUserOnlineIPAge.DeletePartialMatch(instLabel)
+	xrayUserOnlineIPErrors.DeletePartialMatch(instLabel)
+	xrayOnlineIPWorkers.DeletePartialMatch(instLabel)
+	xrayScrapePartial.WithLabelValues(inst.name).Set(0)
+}
+
+// processedStatCategories are the values of the category label of
+// xray_stats_processed_total.
+var processedStatCategories = []string{"traffic", "user", "zero", "filtered", "other"}
+
+// countProcessedStats adds the stats of one scrape cycle to
+// xray_stats_processed_total, by whether they are exported as traffic and
+// why not otherwise.
+func countProcessedStats(instance string, stats []*statsService.Stat) {
+	counts := make(map[string]int)
+	skipped := eachTrafficStat(stats, func(typ, _, _ string, _ int64) {
+		if typ == "user" {
+			counts["user"]++
+		} else {
+			counts["traffic"]++
+		}
+	})
+	maps.Copy(counts, skipped)
+	for _, category := range processedStatCategories {
+		xrayStatsProcessed.WithLabelValues(instance, category).Add(float64(counts[category]))
+	}
+}
+
+// userFilterReasons are the values of the reason label of
+// xray_users_filtered_total.
+var userFilterReasons = []string{"exclude", "not_included"}
+
+// countFilteredUsers adds the users dropped by the user filters in one
+// scrape cycle, user -> reason, to xray_users_filtered_total.
+func countFilteredUsers(instance string, filtered map[string]string) {
+	counts := make(map[string]int)
+	for _, reason := range filtered {
+		counts[reason]++
+	}
+	for _, reason := range userFilterReasons {
+		xrayUsersFiltered.WithLabelValues(instance, reason).Add(float64(counts[reason]))
+	}
+}
+
+// onlineResult is the last successful online IP lookup of a user.
+type onlineResult struct {
+	ips       map[string]int64
+	fetchedAt time.Time
+}
+
+// refreshOnlineIPs returns the online IPs of users. With ONLINE_IP_SPREAD=N
+// only every Nth user, round-robin, is queried each cycle and the others are
+// served from their last result, so each user is refreshed every N cycles.
+// Otherwise every user is queried and failed lookups are left out.
+func (i *xrayInstance) refreshOnlineIPs(ctx context.Context, users map[string]struct{}) map[string]map[string]int64 {
+	spread := AppConfig().OnlineIPSpread
+	if spread <= 1 || i.onlineResults == nil {
+		i.onlineResults = make(map[string]onlineResult)
+	}
+
+	due := users
+	if spread > 1 {
+		due = make(map[string]struct{})
+		for n, user := range slices.Sorted(maps.Keys(users)) {
+			if _, cached := i.onlineResults[user]; !cached || n%spread == i.spreadCycle%spread {
+				due[user] = struct{}{}
+			}
+		}
+		i.spreadCycle++
+	}
+
+	now := time.Now()
+	results, unsupported := fetchOnlineIPs(ctx, i.stats, i.name, due)
+	if unsupported {
+		slog.Warn("Xray does not implement GetStatsOnlineIpList, disabling online IP metrics until the next reload", "instance", i.name)
+		i.onlineUnsupported.Store(true)
+	}
+	if i.onlineRefreshed == nil {
+		i.onlineRefreshed = make(map[string]time.Time)
+	}
+	for user, ips := range results {
+		i.onlineResults[user] = onlineResult{ips: ips, fetchedAt: now}
+		i.onlineRefreshed[user] = now
+	}
+	partial := 0.0
+	if failed := len(due) - len(results); failed > 0 && !unsupported {
+		partial = 1
+	}
+	xrayScrapePartial.WithLabelValues(i.name).Set(partial)
+
+	// Unlike onlineResults the refresh times survive failed lookups, so the
+	// age of a user that keeps failing keeps growing
+	xrayUserOnlineIPAge.DeletePartialMatch(prometheus.Labels{"instance": i.name})
+	for user, refreshed := range i.onlineRefreshed {
+		if _, ok := users[user]; !ok {
+			delete(i.onlineRefreshed, user)
+			continue
+		}
+		xrayUserOnlineIPAge.WithLabelValues(i.name, AppConfig().UserAlias(user)).Set(now.Sub(refreshed).Seconds())
+	}
+
+	online := make(map[string]map[string]int64, len(i.onlineResults))
+	var maxAge time.Duration
+	for user, result := range i.onlineResults {
+		if _, ok := users[user]; !ok {
+			delete(i.onlineResults, user)
+			continue
+		}
+		online[user] = result.ips
+		maxAge = max(maxAge, now.Sub(result.fetchedAt))
+	}
+	xrayOnlineIPsMaxAge.WithLabelValues(i.name).Set(maxAge.Seconds())
+	return online
+}
+
+// fetchOnlineIPs queries the online IP list of every user using a bounded
+// pool of workers. Users whose lookup fails are logged and left out, once
+// Xray answers Unimplemented the remaining users are skipped and
+// unsupported is reported instead.
+func fetchOnlineIPs(ctx context.Context, client statsService.StatsServiceClient, instance string, users map[string]struct{}) (results map[string]map[string]int64, unsupported bool) {
+	var (
+		mu            sync.Mutex
+		wg            sync.WaitGroup
+		unimplemented atomic.Bool
+		jobs          = make(chan string)
+	)
+	results = make(map[string]map[string]int64, len(users))
+
+	active := xrayOnlineIPWorkers.WithLabelValues(instance)
+	for range min(AppConfig().OnlineIPConcurrency, len(users)) {
+		wg.Go(func() {
+			for user := range jobs {
+				if unimplemented.Load() {
+					continue
+				}
+				rpcCtx, cancel := context.WithTimeout(ctx, AppConfig().RPCTimeout)
+				active.Inc()
+				ipResp, err := client.GetStatsOnlineIpList(rpcCtx, &statsService.GetStatsRequest{
+					Name: "user>>>" + user + ">>>online",
+				})
+				active.Dec()
+				cancel()
+				if status.Code(err) == codes.Unimplemented {
+					unimplemented.Store(true)
+					continue
+				}
+				if err != nil {
+					xrayUserOnlineIPErrors.WithLabelValues(instance, AppConfig().UserAlias(user)).Inc()
+					slog.Error("GetStatsOnlineIpList error", "instance", instance, "user", user, "error", err)
+					continue
+				}
+
+				mu.Lock()
+				results[user] = ipResp.Ips
+				mu.Unlock()
+			}
+		})
+	}
+
+	for user := range users {
+		jobs <- user
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results, unimplemented.Load()
+}
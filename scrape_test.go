@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+func TestScrapeDelay(t *testing.T) {
+	defaults := Config{
+		ScrapeInterval: 5 * time.Second,
+		FailInterval:   15 * time.Second,
+		FailThreshold:  3,
+		FailBackoffMax: 2 * time.Minute,
+	}
+	lowMax := defaults
+	lowMax.FailBackoffMax = 10 * time.Second
+	firstFailure := defaults
+	firstFailure.FailThreshold = 1
+
+	tests := []struct {
+		name      string
+		cfg       Config
+		failCount int
+		want      time.Duration
+	}{
+		{"no failure", defaults, 0, 5 * time.Second},
+		{"below threshold", defaults, 2, 5 * time.Second},
+		{"at threshold", defaults, 3, 15 * time.Second},
+		{"doubles", defaults, 4, 30 * time.Second},
+		{"doubles again", defaults, 5, time.Minute},
+		{"reaches the cap", defaults, 6, 2 * time.Minute},
+		{"stays at the cap", defaults, 7, 2 * time.Minute},
+		{"many failures", defaults, 1000, 2 * time.Minute},
+		{"cap below FAIL_INTERVAL", lowMax, 3, 15 * time.Second},
+		{"cap below FAIL_INTERVAL after more failures", lowMax, 6, 15 * time.Second},
+		{"threshold 1", firstFailure, 1, 15 * time.Second},
+		{"threshold 1 doubles", firstFailure, 2, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scrapeDelay(&tt.cfg, tt.failCount); got != tt.want {
+				t.Errorf("scrapeDelay(%d) = %v, want %v", tt.failCount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxIPsPerUserWarnsOnce(t *testing.T) {
+	setTestConfig(t, map[string]string{"MAX_IPS_PER_USER": "1"})
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	stats := &fakeStats{
+		stats:  []*statsService.Stat{stat("user>>>alice>>>traffic>>>uplink", 10)},
+		online: map[string]map[string]int64{"alice": {"203.0.113.1": 1, "203.0.113.2": 1}},
+	}
+	inst := newTestInstance(t, "test-max-ips", stats)
+	for range 3 {
+		if _, err := scrapeOnlineUsersAndHealth(context.Background(), inst); err != nil {
+			t.Fatalf("scrapeOnlineUsersAndHealth: %v", err)
+		}
+	}
+	if n := strings.Count(logs.String(), "MAX_IPS_PER_USER"); n != 1 {
+		t.Errorf("%d MAX_IPS_PER_USER warnings after 3 scrapes, want 1:\n%s", n, logs.String())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ================= SCRAPE HISTORY =================
+
+// scrapeHistorySize caps the scrapes /debug/scrapes remembers.
+const scrapeHistorySize = 100
+
+type scrapeRecord struct {
+	Instance        string    `json:"instance"`
+	Time            time.Time `json:"time"`
+	Success         bool      `json:"success"`
+	Error           string    `json:"error,omitempty"`
+	Users           int       `json:"users"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+func newScrapeRecord(instance string, start time.Time, duration time.Duration, users int, err error) scrapeRecord {
+	record := scrapeRecord{
+		Instance:        instance,
+		Time:            start,
+		Success:         err == nil,
+		Users:           users,
+		DurationSeconds: duration.Seconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// scrapeHistory is a ring buffer of the most recent scrapes of all
+// instances, written by the scrape loops and read by the debug endpoint.
+type scrapeHistory struct {
+	mu      sync.Mutex
+	records []scrapeRecord
+	next    int
+}
+
+var recentScrapes = &scrapeHistory{records: make([]scrapeRecord, 0, scrapeHistorySize)}
+
+func (h *scrapeHistory) add(record scrapeRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) < cap(h.records) {
+		h.records = append(h.records, record)
+		return
+	}
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
+}
+
+// list returns the recorded scrapes, oldest first.
+func (h *scrapeHistory) list() []scrapeRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]scrapeRecord, 0, len(h.records))
+	out = append(out, h.records[h.next:]...)
+	return append(out, h.records[:h.next]...)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/protobuf/proto"
+)
+
+// ================= STATS CACHE =================
+
+// statsCache shares a single QueryStats snapshot between the traffic
+// collector and the scrape loop. A snapshot younger than ttl is served from
+// memory; otherwise it is refreshed while holding the lock so concurrent
+// callers wait for the same RPC instead of issuing their own.
+//
+// In reset mode every query zeroes the counters inside Xray and the cache
+// keeps the running totals itself, so consumers still see monotonic values.
+// Reset does the same on demand for RESET_SCHEDULE, the totals are then
+// added to the values of the queries in between.
+type statsCache struct {
+	client statsService.StatsServiceClient
+	ttl    time.Duration
+	reset  bool
+
+	mu        sync.Mutex
+	stats     []*statsService.Stat
+	fetchedAt time.Time
+	totals    map[string]int64
+	overLimit bool
+	lastErr   error
+}
+
+func newStatsCache(client statsService.StatsServiceClient, ttl time.Duration, reset bool) *statsCache {
+	return &statsCache{
+		client: client,
+		ttl:    ttl,
+		reset:  reset,
+		totals: make(map[string]int64),
+	}
+}
+
+// Get returns the current snapshot, a refresh runs under ctx bounded by
+// RPC_TIMEOUT. A cancelled refresh leaves the old snapshot in place for the
+// next caller to retry.
+func (c *statsCache) Get(ctx context.Context) ([]*statsService.Stat, error) {
+	stats, _, err := c.Snapshot(ctx)
+	return stats, err
+}
+
+// Snapshot is Get that also returns when the stats were read from Xray, so
+// callers can tell a cached snapshot from a new one.
+func (c *statsCache) Snapshot(ctx context.Context) ([]*statsService.Stat, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < c.ttl {
+		return c.stats, c.fetchedAt, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, AppConfig().RPCTimeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := c.client.QueryStats(ctx, &statsService.QueryStatsRequest{
+		Pattern: "",
+		Reset_:  c.reset,
+	})
+	// A scrape the scraper gave up on says nothing about Xray
+	if !errors.Is(err, context.Canceled) {
+		c.lastErr = err
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// proto.Size walks the whole response, so only when it gets logged
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		slog.Debug("QueryStats returned", "stats", len(resp.Stat), "bytes", proto.Size(resp), "duration", time.Since(start))
+	}
+
+	switch {
+	case c.reset:
+		c.stats = c.accumulate(resp.Stat)
+	case len(c.totals) > 0:
+		c.stats = c.withTotals(resp.Stat)
+	default:
+		c.stats = resp.Stat
+	}
+	c.stats = c.limit(c.stats)
+	c.fetchedAt = time.Now()
+	return c.stats, c.fetchedAt, nil
+}
+
+// limit cuts stats down to STATS_SOFT_LIMIT. The limit is shared evenly
+// between the stat types, the part of the name before the first >>>, and a
+// share a type doesn't use goes to the others, so thousands of user stats
+// can't crowd out the inbounds and outbounds. Within a type the first names
+// in sort order are kept so the same stats survive every refresh. Reset mode
+// totals are accumulated before, so they keep counting. Must be called with
+// mu held.
+func (c *statsCache) limit(stats []*statsService.Stat) []*statsService.Stat {
+	limit := AppConfig().StatsSoftLimit
+	over := limit > 0 && len(stats) > limit
+	if over != c.overLimit {
+		if over {
+			slog.Warn("QueryStats exceeds STATS_SOFT_LIMIT, dropping the stats above it", "stats", len(stats), "limit", limit)
+		} else {
+			slog.Info("QueryStats is within STATS_SOFT_LIMIT again", "stats", len(stats), "limit", limit)
+		}
+		c.overLimit = over
+	}
+	if !over {
+		return stats
+	}
+
+	byType := make(map[string][]*statsService.Stat)
+	for _, stat := range stats {
+		typ, _, _ := strings.Cut(stat.Name, ">>>")
+		byType[typ] = append(byType[typ], stat)
+	}
+	// Smallest types first, so what they leave of their share is known
+	// before the larger ones are cut
+	types := slices.SortedFunc(maps.Keys(byType), func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(byType[a]), len(byType[b])), strings.Compare(a, b))
+	})
+	out := make([]*statsService.Stat, 0, limit)
+	for i, typ := range types {
+		group := byType[typ]
+		if share := (limit - len(out)) / (len(types) - i); len(group) > share {
+			slices.SortFunc(group, func(a, b *statsService.Stat) int {
+				return strings.Compare(a.Name, b.Name)
+			})
+			group = group[:share]
+		}
+		out = append(out, group...)
+	}
+	return out
+}
+
+// Last returns the current snapshot without refreshing it, along with the
+// error of the last refresh. Before the first refresh the snapshot is empty
+// and its time zero.
+func (c *statsCache) Last() ([]*statsService.Stat, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats, c.fetchedAt, c.lastErr
+}
+
+// Reset reads the stats with Reset_ set, zeroing the counters inside Xray,
+// and keeps their values in the running totals.
+func (c *statsCache) Reset(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, AppConfig().RPCTimeout)
+	defer cancel()
+
+	resp, err := c.client.QueryStats(ctx, &statsService.QueryStatsRequest{
+		Pattern: "",
+		Reset_:  true,
+	})
+	if err != nil {
+		return err
+	}
+	c.stats = c.limit(c.accumulate(resp.Stat))
+	c.fetchedAt = time.Now()
+	return nil
+}
+
+// withTotals returns stats with the totals kept by Reset added to their
+// values. Must be called with mu held.
+func (c *statsCache) withTotals(stats []*statsService.Stat) []*statsService.Stat {
+	out := make([]*statsService.Stat, 0, max(len(stats), len(c.totals)))
+	seen := make(map[string]struct{}, len(stats))
+	for _, stat := range stats {
+		out = append(out, &statsService.Stat{Name: stat.Name, Value: c.totals[stat.Name] + stat.Value})
+		seen[stat.Name] = struct{}{}
+	}
+	for name, value := range c.totals {
+		if _, ok := seen[name]; !ok {
+			out = append(out, &statsService.Stat{Name: name, Value: value})
+		}
+	}
+	return out
+}
+
+// accumulate adds the values read since the last reset to the running
+// totals and returns the totals as stats. Must be called with mu held.
+func (c *statsCache) accumulate(stats []*statsService.Stat) []*statsService.Stat {
+	for _, stat := range stats {
+		c.totals[stat.Name] += stat.Value
+	}
+
+	out := make([]*statsService.Stat, 0, len(c.totals))
+	for name, value := range c.totals {
+		out = append(out, &statsService.Stat{Name: name, Value: value})
+	}
+	return out
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+func TestStatsSoftLimit(t *testing.T) {
+	setTestConfig(t, map[string]string{"STATS_SOFT_LIMIT": "5"})
+	stats := &fakeStats{stats: []*statsService.Stat{
+		stat("user>>>dave>>>traffic>>>uplink", 1),
+		stat("user>>>carol>>>traffic>>>uplink", 1),
+		stat("user>>>bob>>>traffic>>>uplink", 1),
+		stat("user>>>alice>>>traffic>>>uplink", 1),
+		stat("outbound>>>direct>>>traffic>>>uplink", 1),
+		stat("inbound>>>vless-in>>>traffic>>>uplink", 1),
+		stat("inbound>>>api>>>traffic>>>uplink", 1),
+	}}
+
+	got, err := newStatsCache(stats, 0, false).Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, stat := range got {
+		names = append(names, stat.Name)
+	}
+	slices.Sort(names)
+	// The outbound and inbounds fit their shares, the users get what is left
+	want := []string{
+		"inbound>>>api>>>traffic>>>uplink",
+		"inbound>>>vless-in>>>traffic>>>uplink",
+		"outbound>>>direct>>>traffic>>>uplink",
+		"user>>>alice>>>traffic>>>uplink",
+		"user>>>bob>>>traffic>>>uplink",
+	}
+	if !slices.Equal(names, want) {
+		t.Errorf("stats = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ================= SYS STATS COLLECTOR (CUSTOM) =================
+
+type sysStatMetric struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(*statsService.SysStatsResponse) float64
+}
+
+type XraySysStatsCollector struct {
+	ctx     context.Context
+	client  statsService.StatsServiceClient
+	metrics []sysStatMetric
+}
+
+func NewXraySysStatsCollector(ctx context.Context, client statsService.StatsServiceClient) *XraySysStatsCollector {
+	newMetric := func(name, help string, valueType prometheus.ValueType, value func(*statsService.SysStatsResponse) float64) sysStatMetric {
+		return sysStatMetric{
+			desc:      prometheus.NewDesc(metricName(name), help, nil, nil),
+			valueType: valueType,
+			value:     value,
+		}
+	}
+
+	return &XraySysStatsCollector{
+		ctx:    ctx,
+		client: client,
+		metrics: []sysStatMetric{
+			newMetric("sys_uptime_seconds", "Xray process uptime in seconds", prometheus.GaugeValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.Uptime) }),
+			newMetric("sys_goroutines", "Number of goroutines in Xray", prometheus.GaugeValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.NumGoroutine) }),
+			newMetric("sys_alloc_bytes", "Bytes of allocated heap objects in Xray", prometheus.GaugeValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.Alloc) }),
+			newMetric("sys_total_alloc_bytes_total", "Cumulative bytes allocated for heap objects in Xray", prometheus.CounterValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.TotalAlloc) }),
+			newMetric("sys_bytes", "Bytes of memory obtained from the OS by Xray", prometheus.GaugeValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.Sys) }),
+			newMetric("sys_mallocs_total", "Cumulative count of heap objects allocated in Xray", prometheus.CounterValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.Mallocs) }),
+			newMetric("sys_frees_total", "Cumulative count of heap objects freed in Xray", prometheus.CounterValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.Frees) }),
+			newMetric("sys_live_objects", "Number of live heap objects in Xray", prometheus.GaugeValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.LiveObjects) }),
+			newMetric("sys_num_gc_total", "Number of completed GC cycles in Xray", prometheus.CounterValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.NumGC) }),
+			newMetric("sys_gc_pause_seconds_total", "Cumulative GC pause time in Xray", prometheus.CounterValue,
+				func(r *statsService.SysStatsResponse) float64 { return float64(r.PauseTotalNs) / 1e9 }),
+		},
+	}
+}
+
+func (c *XraySysStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.metrics {
+		ch <- m.desc
+	}
+}
+
+func (c *XraySysStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(c.ctx, AppConfig().RPCTimeout)
+	defer cancel()
+
+	resp, err := c.client.GetSysStats(ctx, &statsService.SysStatsRequest{})
+	if err != nil {
+		slog.Error("SysStatsCollector error during GetSysStats", "error", err)
+		return
+	}
+
+	for _, m := range c.metrics {
+		ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, m.value(resp))
+	}
+}
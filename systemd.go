@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// ================= SYSTEMD NOTIFY =================
+
+// notifySystemd reports readiness to systemd once the first scrape of any
+// instance has succeeded, and pings the watchdog while ctx is alive when the
+// unit sets WatchdogSec. Outside a Type=notify unit NOTIFY_SOCKET is unset
+// and it returns right away. Callers start it once the HTTP server
+// is listening.
+func notifySystemd(ctx context.Context, instances *instanceSet) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	watchdog, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Warn("Invalid systemd watchdog settings, not pinging the watchdog", "error", err)
+	}
+	var ping <-chan time.Time
+	if watchdog > 0 {
+		ticker := time.NewTicker(watchdog / 2)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	poll := time.NewTicker(250 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			sdNotify(daemon.SdNotifyStopping)
+			return
+		case <-ping:
+			sdNotify(daemon.SdNotifyWatchdog)
+		case <-poll.C:
+			if slices.ContainsFunc(instances.List(), func(i *xrayInstance) bool { return i.up.Load() }) {
+				sdNotify(daemon.SdNotifyReady)
+				poll.Stop()
+			}
+		}
+	}
+}
+
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		slog.Warn("systemd notification failed", "state", state, "error", err)
+	}
+}
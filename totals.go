@@ -0,0 +1,52 @@
+package main
+
+import (
+	"maps"
+	"sync"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+// ================= TRAFFIC TOTALS =================
+
+// trafficTotals sums the inbound traffic of an instance by direction for
+// xray_traffic_uplink_bytes_sum_total and xray_traffic_downlink_bytes_sum_total.
+// Every byte passes an inbound, the outbound and user counters would count
+// it again. The sums grow by the growth of each counter, so they stay
+// monotonic when an inbound goes away or Xray restarts. The inbounds are
+// summed whatever TRAFFIC_TYPE_DENY, the filters and XRAY_CONFIG_FILE names
+// say, those only change which series are exported, not the traffic.
+type trafficTotals struct {
+	mu     sync.Mutex
+	prev   map[[2]string]int64
+	totals map[string]int64
+}
+
+// update adds the growth of the inbound counters since the previous snapshot
+// and returns the totals by direction. The first snapshot adds the whole
+// counters, as does a counter that went down or is new since the previous
+// one. A snapshot seen before adds nothing.
+func (t *trafficTotals) update(stats []*statsService.Stat) map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.totals == nil {
+		t.totals = make(map[string]int64)
+	}
+	current := make(map[[2]string]int64)
+	for _, stat := range stats {
+		if typ, tag, direction, ok := parseTraffic(stat.Name); ok && typ == "inbound" {
+			current[[2]string{tag, direction}] = stat.Value
+		}
+	}
+
+	for key, value := range current {
+		delta := value
+		if last, ok := t.prev[key]; ok && value >= last {
+			delta = value - last
+		}
+		t.totals[key[1]] += delta
+	}
+	t.prev = current
+	return maps.Clone(t.totals)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+func TestTrafficTotals(t *testing.T) {
+	// Denying inbounds hides their series, the totals still sum them
+	setTestConfig(t, map[string]string{"TRAFFIC_TYPE_DENY": "inbound"})
+	var totals trafficTotals
+
+	steps := []struct {
+		name  string
+		stats []*statsService.Stat
+		want  map[string]int64
+	}{
+		{"first snapshot", []*statsService.Stat{
+			stat("inbound>>>vless-in>>>traffic>>>uplink", 10),
+			stat("inbound>>>vless-in>>>traffic>>>downlink", 100),
+			stat("inbound>>>api>>>traffic>>>uplink", 5),
+			stat("outbound>>>direct>>>traffic>>>uplink", 1000),
+			stat("user>>>alice>>>traffic>>>uplink", 1000),
+		}, map[string]int64{"uplink": 15, "downlink": 100}},
+		{"growth", []*statsService.Stat{
+			stat("inbound>>>vless-in>>>traffic>>>uplink", 20),
+			stat("inbound>>>vless-in>>>traffic>>>downlink", 150),
+			stat("inbound>>>api>>>traffic>>>uplink", 5),
+		}, map[string]int64{"uplink": 25, "downlink": 150}},
+		{"Xray restarted", []*statsService.Stat{
+			stat("inbound>>>vless-in>>>traffic>>>uplink", 3),
+			stat("inbound>>>vless-in>>>traffic>>>downlink", 7),
+		}, map[string]int64{"uplink": 28, "downlink": 157}},
+	}
+	for _, step := range steps {
+		if got := totals.update(step.stats); !maps.Equal(got, step.want) {
+			t.Errorf("%s: totals = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestTrafficTotalsCollected(t *testing.T) {
+	setTestConfig(t, map[string]string{"ENABLE_TRAFFIC_TOTALS": "true"})
+	stats := &fakeStats{stats: []*statsService.Stat{
+		stat("inbound>>>vless-in>>>traffic>>>uplink", 10),
+		stat("inbound>>>vless-in>>>traffic>>>downlink", 20),
+	}}
+	c := NewXrayTrafficCollector(context.Background(), newStatsCache(stats, 0, false), &trafficTotals{})
+
+	// Counters need the _total suffix, OpenMetrics calls them unknown otherwise
+	expected := `
+# HELP xray_traffic_downlink_bytes_sum_total Xray downlink traffic summed over all inbounds, including denied ones; outbound and user stats count the same bytes again
+# TYPE xray_traffic_downlink_bytes_sum_total counter
+xray_traffic_downlink_bytes_sum_total 20
+# HELP xray_traffic_uplink_bytes_sum_total Xray uplink traffic summed over all inbounds, including denied ones; outbound and user stats count the same bytes again
+# TYPE xray_traffic_uplink_bytes_sum_total counter
+xray_traffic_uplink_bytes_sum_total 10
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"xray_traffic_uplink_bytes_sum_total", "xray_traffic_downlink_bytes_sum_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ================= TRAFFIC COLLECTOR (CUSTOM) =================
+
+// knownTrafficTypes are the stat prefixes Xray uses for traffic counters,
+// they are the only values xray_traffic_bytes_total exports as type.
+var knownTrafficTypes = map[string]struct{}{
+	"inbound":  {},
+	"outbound": {},
+	"user":     {},
+}
+
+// knownDirections are the directions Xray reports traffic for.
+var knownDirections = []string{"uplink", "downlink"}
+
+type XrayTrafficCollector struct {
+	ctx            context.Context
+	cache          *statsCache
+	totals         *trafficTotals
+	trafficDesc    *prometheus.Desc
+	userTotalsDesc *prometheus.Desc
+	connDescs      map[string]*prometheus.Desc
+	splitDescs     map[string]*prometheus.Desc
+	infoDescs      map[string]*prometheus.Desc
+	totalDescs     map[string]*prometheus.Desc
+}
+
+func NewXrayTrafficCollector(ctx context.Context, cache *statsCache, totals *trafficTotals) *XrayTrafficCollector {
+	return &XrayTrafficCollector{
+		ctx:    ctx,
+		cache:  cache,
+		totals: totals,
+		trafficDesc: prometheus.NewDesc(
+			metricName("traffic_bytes_total"),
+			"Xray traffic statistics",
+			[]string{"type", "name", "direction"},
+			nil,
+		),
+		userTotalsDesc: prometheus.NewDesc(
+			metricName("user_traffic_bytes_total"),
+			"Xray user traffic summed over both directions",
+			[]string{"name"},
+			nil,
+		),
+		splitDescs: map[string]*prometheus.Desc{
+			"uplink": prometheus.NewDesc(
+				metricName("traffic_uplink_bytes_total"),
+				"Xray uplink traffic statistics",
+				[]string{"type", "name"},
+				nil,
+			),
+			"downlink": prometheus.NewDesc(
+				metricName("traffic_downlink_bytes_total"),
+				"Xray downlink traffic statistics",
+				[]string{"type", "name"},
+				nil,
+			),
+		},
+		infoDescs: map[string]*prometheus.Desc{
+			"inbound": prometheus.NewDesc(
+				metricName("inbound_info"),
+				"Inbound tags with traffic stats in Xray (constant 1)",
+				[]string{"tag"},
+				nil,
+			),
+			"outbound": prometheus.NewDesc(
+				metricName("outbound_info"),
+				"Outbound tags with traffic stats in Xray (constant 1)",
+				[]string{"tag"},
+				nil,
+			),
+		},
+		totalDescs: map[string]*prometheus.Desc{
+			"uplink": prometheus.NewDesc(
+				metricName("traffic_uplink_bytes_sum_total"),
+				"Xray uplink traffic summed over all inbounds, including denied ones; outbound and user stats count the same bytes again",
+				nil,
+				nil,
+			),
+			"downlink": prometheus.NewDesc(
+				metricName("traffic_downlink_bytes_sum_total"),
+				"Xray downlink traffic summed over all inbounds, including denied ones; outbound and user stats count the same bytes again",
+				nil,
+				nil,
+			),
+		},
+		connDescs: map[string]*prometheus.Desc{
+			"inbound": prometheus.NewDesc(
+				metricName("inbound_connections_total"),
+				"Xray connections handled per inbound, if the Xray build reports them",
+				[]string{"tag"},
+				nil,
+			),
+			"outbound": prometheus.NewDesc(
+				metricName("outbound_connections_total"),
+				"Xray connections handled per outbound, if the Xray build reports them",
+				[]string{"tag"},
+				nil,
+			),
+		},
+	}
+}
+
+func (c *XrayTrafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.trafficDesc
+	ch <- c.userTotalsDesc
+	for _, desc := range c.connDescs {
+		ch <- desc
+	}
+	for _, desc := range c.splitDescs {
+		ch <- desc
+	}
+	for _, desc := range c.infoDescs {
+		ch <- desc
+	}
+	for _, desc := range c.totalDescs {
+		ch <- desc
+	}
+}
+
+func (c *XrayTrafficCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, fetchedAt, err := c.cache.Snapshot(c.ctx)
+	if err != nil {
+		slog.Error("TrafficCollector error during QueryStats", "error", err)
+		return
+	}
+
+	// Exemplars only show up in OpenMetrics output, the text format drops
+	// them, and label-less ones are dropped there too, so they are only
+	// added for scrapes carrying a trace
+	var exemplarLabels prometheus.Labels
+	if AppConfig().Exemplars {
+		if traceID := traceIDFromContext(c.ctx); traceID != "" {
+			exemplarLabels = prometheus.Labels{"trace_id": traceID}
+		}
+	}
+
+	cfg := AppConfig()
+	tagName := liveTagNames(cfg, stats)
+	split := cfg.SplitTraffic
+	userTotals := make(map[string]int64)
+	eachTrafficStat(stats, func(typ, name, direction string, value int64) {
+		m := prometheus.MustNewConstMetric(
+			c.trafficDesc,
+			prometheus.CounterValue,
+			float64(value),
+			typ, name, cfg.DirectionLabel(direction),
+		)
+		if exemplarLabels != nil {
+			m = prometheus.MustNewMetricWithExemplars(m, prometheus.Exemplar{
+				Value:     float64(value),
+				Labels:    exemplarLabels,
+				Timestamp: fetchedAt,
+			})
+		}
+		ch <- m
+		// Directions other than uplink and downlink have no split counter
+		if desc, ok := c.splitDescs[direction]; ok && split {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), typ, name)
+		}
+		if typ == "user" {
+			userTotals[name] += value
+		}
+	})
+
+	// Tags whose counters are still zero belong to the inventory as well
+	tags := make(map[[2]string]struct{})
+	for _, stat := range stats {
+		typ, tag, _, ok := parseTraffic(stat.Name)
+		if _, info := c.infoDescs[typ]; ok && info && !slices.Contains(AppConfig().TrafficTypeDeny, typ) {
+			tags[[2]string{typ, tagName(typ, tag)}] = struct{}{}
+		}
+	}
+	for key := range tags {
+		ch <- prometheus.MustNewConstMetric(c.infoDescs[key[0]], prometheus.GaugeValue, 1, key[1])
+	}
+
+	for _, stat := range stats {
+		if typ, tag, ok := parseConnections(stat.Name); ok && !slices.Contains(AppConfig().TrafficTypeDeny, typ) {
+			ch <- prometheus.MustNewConstMetric(c.connDescs[typ], prometheus.CounterValue, float64(stat.Value), tagName(typ, tag))
+		}
+	}
+
+	if AppConfig().UserTotals {
+		for name, total := range userTotals {
+			ch <- prometheus.MustNewConstMetric(c.userTotalsDesc, prometheus.CounterValue, float64(total), name)
+		}
+	}
+
+	if cfg.TrafficTotals {
+		for direction, total := range c.totals.update(stats) {
+			// Directions other than uplink and downlink have no total
+			if desc, ok := c.totalDescs[direction]; ok {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(total))
+			}
+		}
+	}
+}
+
+// eachTrafficStat calls fn for every non-zero traffic stat, zero ones too
+// with INCLUDE_ZERO_TRAFFIC, of a known type not in TRAFFIC_TYPE_DENY whose
+// user, if any, passes the user filters. Users are passed by their alias,
+// inbound and outbound tags by their XRAY_CONFIG_FILE name unless that is
+// another tag in stats.
+// A user whose alias is the name of another user in stats is skipped as
+// filtered, its series would collide with the other user's. The skipped
+// stats are counted by reason, zero, filtered or other for stats that aren't
+// traffic of a known type.
+func eachTrafficStat(stats []*statsService.Stat, fn func(typ, name, direction string, value int64)) (skipped map[string]int) {
+	return eachTrafficStatRaw(stats, func(stat *statsService.Stat, typ, name, direction string) {
+		fn(typ, name, direction, stat.Value)
+	})
+}
+
+// eachTrafficStatRaw is eachTrafficStat that also passes the stat itself,
+// for callers keyed on the stat name rather than the exported name.
+func eachTrafficStatRaw(stats []*statsService.Stat, fn func(stat *statsService.Stat, typ, name, direction string)) (skipped map[string]int) {
+	skipped = make(map[string]int)
+	deny := AppConfig().TrafficTypeDeny
+	includeZero := AppConfig().IncludeZeroTraffic
+	tagName := liveTagNames(AppConfig(), stats)
+	users := statUsers(stats)
+	for _, stat := range stats {
+		if stat.Value == 0 && !includeZero {
+			skipped["zero"]++
+			continue
+		}
+		typ, nameLabel, direction, ok := parseTraffic(stat.Name)
+		if !ok {
+			skipped["other"]++
+			continue
+		}
+		if _, known := knownTrafficTypes[typ]; !known {
+			slog.Debug("Dropping traffic stat with unknown type", "stat", stat.Name, "type", typ)
+			skipped["other"]++
+			continue
+		}
+		if slices.Contains(deny, typ) {
+			skipped["filtered"]++
+			continue
+		}
+		if typ == "user" {
+			if !AppConfig().UserAllowed(nameLabel) {
+				skipped["filtered"]++
+				continue
+			}
+			if aliasTaken(users, nameLabel) {
+				skipped["filtered"]++
+				continue
+			}
+			nameLabel = AppConfig().UserAlias(nameLabel)
+		} else {
+			nameLabel = tagName(typ, nameLabel)
+		}
+		fn(stat, typ, nameLabel, direction)
+	}
+	return skipped
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+func TestEachTrafficStatTypes(t *testing.T) {
+	setTestConfig(t, nil)
+	stats := []*statsService.Stat{
+		stat("inbound>>>vless-in>>>traffic>>>uplink", 1),
+		stat("outbound>>>direct>>>traffic>>>downlink", 2),
+		stat("user>>>alice>>>traffic>>>uplink", 3),
+		stat("reverse>>>portal>>>traffic>>>uplink", 4),
+		stat("user>>>alice>>>online", 5),
+	}
+
+	var got [][3]string
+	skipped := eachTrafficStat(stats, func(typ, name, direction string, _ int64) {
+		got = append(got, [3]string{typ, name, direction})
+	})
+	want := [][3]string{
+		{"inbound", "vless-in", "uplink"},
+		{"outbound", "direct", "downlink"},
+		{"user", "alice", "uplink"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+	// The unknown reverse type and the online stat
+	if skipped["other"] != 2 {
+		t.Errorf(`skipped["other"] = %d, want 2`, skipped["other"])
+	}
+}
+
+func TestSplitTraffic(t *testing.T) {
+	setTestConfig(t, map[string]string{"ENABLE_SPLIT_TRAFFIC": "true"})
+	stats := &fakeStats{stats: []*statsService.Stat{
+		stat("inbound>>>vless-in>>>traffic>>>uplink", 10),
+		stat("inbound>>>vless-in>>>traffic>>>downlink", 20),
+		stat("user>>>alice>>>traffic>>>downlink", 30),
+		// Only uplink and downlink have a split counter
+		stat("inbound>>>vless-in>>>traffic>>>total", 40),
+	}}
+	c := NewXrayTrafficCollector(context.Background(), newStatsCache(stats, 0, false), &trafficTotals{})
+
+	expected := `
+# HELP xray_traffic_downlink_bytes_total Xray downlink traffic statistics
+# TYPE xray_traffic_downlink_bytes_total counter
+xray_traffic_downlink_bytes_total{name="alice",type="user"} 30
+xray_traffic_downlink_bytes_total{name="vless-in",type="inbound"} 20
+# HELP xray_traffic_uplink_bytes_total Xray uplink traffic statistics
+# TYPE xray_traffic_uplink_bytes_total counter
+xray_traffic_uplink_bytes_total{name="vless-in",type="inbound"} 10
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"xray_traffic_uplink_bytes_total", "xray_traffic_downlink_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrafficExemplars(t *testing.T) {
+	setTestConfig(t, map[string]string{"ENABLE_EXEMPLARS": "true"})
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traced := httptest.NewRequest("GET", "/metrics", nil)
+	traced.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		traceID string
+	}{
+		{"traceparent", withTraceID(traced), traceID},
+		// Label-less exemplars would be dropped from the output anyway
+		{"no traceparent", context.Background(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &fakeStats{stats: []*statsService.Stat{stat("inbound>>>vless-in>>>traffic>>>uplink", 10)}}
+			c := NewXrayTrafficCollector(tt.ctx, newStatsCache(stats, 0, false), &trafficTotals{})
+
+			ch := make(chan prometheus.Metric, 10)
+			c.Collect(ch)
+			close(ch)
+			for m := range ch {
+				var metric dto.Metric
+				if err := m.Write(&metric); err != nil {
+					t.Fatal(err)
+				}
+				if metric.Counter == nil {
+					continue
+				}
+				exemplar := metric.Counter.Exemplar
+				got := ""
+				for _, label := range exemplar.GetLabel() {
+					if label.GetName() == "trace_id" {
+						got = label.GetValue()
+					}
+				}
+				if got != tt.traceID || (exemplar != nil) != (tt.traceID != "") {
+					t.Errorf("exemplar = %v, want trace_id %q", exemplar, tt.traceID)
+				}
+			}
+		})
+	}
+}
+
+func TestDirectionMappingDerivedMetrics(t *testing.T) {
+	setTestConfig(t, map[string]string{"DIRECTION_MAPPING": "uplink=tx"})
+	const instance = "test-direction"
+	t.Cleanup(func() { deleteInstanceSeries(instance) })
+	snapshot := func(value int64) []*statsService.Stat {
+		return []*statsService.Stat{stat("inbound>>>vless-in>>>traffic>>>uplink", value)}
+	}
+
+	var rates trafficRates
+	var observed observedTraffic
+	start := time.Now()
+	for n, value := range []int64{100, 300} {
+		rates.update(instance, snapshot(value), start.Add(time.Duration(n)*time.Second))
+		observed.update(instance, snapshot(value))
+	}
+
+	// The same traffic is labelled tx in every series
+	if got := testutil.ToFloat64(xrayTrafficRate.WithLabelValues(instance, "inbound", "vless-in", "tx")); got != 200 {
+		t.Errorf("xray_traffic_bytes_per_second{direction=tx} = %v, want 200", got)
+	}
+	if got := testutil.ToFloat64(xrayObservedBytes.WithLabelValues(instance, "inbound", "tx")); got != 200 {
+		t.Errorf("xray_exporter_observed_bytes_total{direction=tx} = %v, want 200", got)
+	}
+	if n := testutil.CollectAndCount(xrayTrafficRate) + testutil.CollectAndCount(xrayObservedBytes); n != 2 {
+		t.Errorf("%d rate and observed series, want only the tx ones", n)
+	}
+}
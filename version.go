@@ -1,3 +1,6 @@
 package main
 
 const Version = "1.0.7"
+
+// Commit is injected at build time with -ldflags "-X main.Commit=<sha>"
+var Commit = "unknown"
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+// ================= XRAY CONFIG TAG NAMES =================
+
+// xrayConfigFile is the part of the Xray server config tag names are built
+// from.
+type xrayConfigFile struct {
+	Inbounds []struct {
+		Tag      string          `json:"tag"`
+		Protocol string          `json:"protocol"`
+		Port     json.RawMessage `json:"port"`
+	} `json:"inbounds"`
+	Outbounds []struct {
+		Tag      string `json:"tag"`
+		Protocol string `json:"protocol"`
+		Settings struct {
+			Vnext []struct {
+				Address string `json:"address"`
+			} `json:"vnext"`
+			Servers []struct {
+				Address string `json:"address"`
+			} `json:"servers"`
+		} `json:"settings"`
+	} `json:"outbounds"`
+}
+
+// loadTagNames reads XRAY_CONFIG_FILE and names every tagged inbound after
+// its protocol and port, e.g. vless-443, and every tagged outbound after its
+// protocol and first server, e.g. vmess-example.com or freedom. Tags whose
+// name would collide with another name or tag of the same type keep their
+// tag. The result maps inbound or outbound to tag -> name.
+func loadTagNames(path string) (map[string]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("XRAY_CONFIG_FILE: %w", err)
+	}
+	var conf xrayConfigFile
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("XRAY_CONFIG_FILE %s: %w", path, err)
+	}
+
+	inbounds, inboundTags := make(map[string]string), make(map[string]struct{})
+	for _, in := range conf.Inbounds {
+		inboundTags[in.Tag] = struct{}{}
+		if in.Tag == "" || in.Protocol == "" {
+			continue
+		}
+		name := in.Protocol
+		if port := strings.Trim(string(in.Port), `"`); port != "" {
+			name += "-" + port
+		}
+		inbounds[in.Tag] = name
+	}
+
+	outbounds, outboundTags := make(map[string]string), make(map[string]struct{})
+	for _, out := range conf.Outbounds {
+		outboundTags[out.Tag] = struct{}{}
+		if out.Tag == "" || out.Protocol == "" {
+			continue
+		}
+		name := out.Protocol
+		if vnext := out.Settings.Vnext; len(vnext) > 0 && vnext[0].Address != "" {
+			name += "-" + vnext[0].Address
+		} else if servers := out.Settings.Servers; len(servers) > 0 && servers[0].Address != "" {
+			name += "-" + servers[0].Address
+		}
+		outbounds[out.Tag] = name
+	}
+
+	return map[string]map[string]string{
+		"inbound":  uniqueTagNames("inbound", inbounds, inboundTags),
+		"outbound": uniqueTagNames("outbound", outbounds, outboundTags),
+	}, nil
+}
+
+// uniqueTagNames drops the names shared by several tags or equal to another
+// tag in the config, their series would collide, so those tags are exported
+// as they are.
+func uniqueTagNames(typ string, names map[string]string, tags map[string]struct{}) map[string]string {
+	owners := make(map[string][]string)
+	for tag, name := range names {
+		owners[name] = append(owners[name], tag)
+	}
+	for name, shared := range owners {
+		if _, isTag := tags[name]; isTag && !(len(shared) == 1 && shared[0] == name) {
+			slog.Warn("Xray config tag name is another tag, keeping the tag", "type", typ, "name", name, "tags", shared)
+		} else if len(shared) > 1 {
+			slog.Warn("Xray config tags share a name, keeping their tags", "type", typ, "name", name, "tags", shared)
+		} else {
+			continue
+		}
+		for _, tag := range shared {
+			delete(names, tag)
+		}
+	}
+	return names
+}
+
+// warnedTagCollisions remembers the names liveTagNames warned about, so a
+// collision is logged once instead of on every collect.
+var warnedTagCollisions sync.Map
+
+// liveTagNames returns cfg.TagName checked against the tags in stats. A name
+// that is also a tag Xray reports for the same type, e.g. when
+// XRAY_CONFIG_FILE is stale, is dropped like in uniqueTagNames and the tag
+// exported as it is, their series would collide otherwise.
+func liveTagNames(cfg *Config, stats []*statsService.Stat) func(typ, tag string) string {
+	if len(cfg.tagNames) == 0 {
+		return cfg.TagName
+	}
+	live := make(map[[2]string]struct{})
+	for _, stat := range stats {
+		if typ, tag, _, ok := parseTraffic(stat.Name); ok {
+			live[[2]string{typ, tag}] = struct{}{}
+		} else if typ, tag, ok := parseConnections(stat.Name); ok {
+			live[[2]string{typ, tag}] = struct{}{}
+		}
+	}
+	return func(typ, tag string) string {
+		name := cfg.TagName(typ, tag)
+		if _, taken := live[[2]string{typ, name}]; taken && name != tag {
+			if _, warned := warnedTagCollisions.LoadOrStore([2]string{typ, name}, struct{}{}); !warned {
+				slog.Warn("Xray config tag name is another tag reported by Xray, keeping the tag", "type", typ, "tag", tag, "name", name)
+			}
+			return tag
+		}
+		return name
+	}
+}
+
+// TagName returns the name exported for the inbound or outbound tag, the
+// tag itself unless XRAY_CONFIG_FILE names it. The names are loaded by
+// Validate.
+func (c *Config) TagName(typ, tag string) string {
+	if name, ok := c.tagNames[typ][tag]; ok {
+		return name
+	}
+	return tag
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+func TestLoadTagNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	conf := `{
+	"inbounds": [
+		{"tag": "in-1", "protocol": "vless", "port": 443},
+		{"tag": "vless-443", "protocol": "vmess", "port": "80"},
+		{"tag": "in-2", "protocol": "trojan", "port": 8443},
+		{"tag": "in-3", "protocol": "trojan", "port": 8443}
+	],
+	"outbounds": [
+		{"tag": "direct", "protocol": "freedom"},
+		{"tag": "proxy", "protocol": "vmess", "settings": {"vnext": [{"address": "example.com"}]}},
+		{"tag": "socks", "protocol": "socks", "settings": {"servers": [{"address": "10.0.0.1"}]}}
+	]
+}`
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := loadTagNames(path)
+	if err != nil {
+		t.Fatalf("loadTagNames: %v", err)
+	}
+	// in-1 would become the literal tag vless-443, in-2 and in-3 share a name
+	wantInbounds := map[string]string{"vless-443": "vmess-80"}
+	if !maps.Equal(names["inbound"], wantInbounds) {
+		t.Errorf("inbound names = %v, want %v", names["inbound"], wantInbounds)
+	}
+	wantOutbounds := map[string]string{"direct": "freedom", "proxy": "vmess-example.com", "socks": "socks-10.0.0.1"}
+	if !maps.Equal(names["outbound"], wantOutbounds) {
+		t.Errorf("outbound names = %v, want %v", names["outbound"], wantOutbounds)
+	}
+}
+
+func TestTagNameCollidingWithLiveTag(t *testing.T) {
+	// The config is stale, Xray reports a tag vless-443 it doesn't know
+	path := filepath.Join(t.TempDir(), "config.json")
+	conf := `{"inbounds": [{"tag": "in-1", "protocol": "vless", "port": 443}]}`
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setTestConfig(t, map[string]string{"XRAY_CONFIG_FILE": path})
+	stats := &fakeStats{stats: []*statsService.Stat{
+		stat("inbound>>>in-1>>>traffic>>>uplink", 10),
+		stat("inbound>>>vless-443>>>traffic>>>uplink", 20),
+	}}
+	c := NewXrayTrafficCollector(context.Background(), newStatsCache(stats, 0, false), &trafficTotals{})
+
+	// Gathering fails on duplicate series, in-1 must keep its tag instead
+	expected := `
+# HELP xray_traffic_bytes_total Xray traffic statistics
+# TYPE xray_traffic_bytes_total counter
+xray_traffic_bytes_total{direction="uplink",name="in-1",type="inbound"} 10
+xray_traffic_bytes_total{direction="uplink",name="vless-443",type="inbound"} 20
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "xray_traffic_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}